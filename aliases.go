@@ -0,0 +1,208 @@
+// Copyright © 2015 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codebase
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dvln/out"
+)
+
+// AliasLink is a symlink in the workspace for a pkg alias, pkgs that were
+// renamed or moved keep their old name and workspace path as aliases and,
+// if the codebase "linkalias" attr is set, the old path is linked to the
+// pkg so existing references to it keep working.  Quick overview:
+//   Pkg: name of the pkg
+//   Alias: the old pkg name
+//   Link: workspace path of the symlink (the old workspace path)
+//   Target: workspace path linked to (the pkg workspace path, see PkgWS())
+// Paths are relative to the workspace root and use forward slashes.
+type AliasLink struct {
+	Pkg    string
+	Alias  string
+	Link   string
+	Target string
+}
+
+// AliasState is the state of an alias symlink in a workspace, see the
+// CheckAliases() method
+type AliasState int
+
+const (
+	// AliasOK indicates the symlink is there and links to the pkg
+	AliasOK AliasState = 1 << iota
+	// AliasMissing indicates there is nothing at the alias path
+	AliasMissing
+	// AliasWrongTarget indicates a symlink that links somewhere else
+	AliasWrongTarget
+	// AliasConflict indicates a real file or dir is at the alias path
+	AliasConflict
+)
+
+// AliasStatus is an alias symlink and its state in a workspace
+type AliasStatus struct {
+	AliasLink
+	State AliasState
+}
+
+// LinkAliases returns true if the codebase "linkalias" attr is set, ie:
+// pkg aliases are to be symlinked in the workspace
+func (cb *Defn) LinkAliases() bool {
+	link, err := strconv.ParseBool(cb.Attrs["linkalias"])
+	return err == nil && link
+}
+
+// AliasLinks returns the alias symlinks for the codebase pkgs (sorted by
+// link path), aliases at the pkg workspace path itself are skipped and
+// alias paths outside the workspace root (eg: "../old") fail (error 3023)
+func (cb *Defn) AliasLinks() ([]AliasLink, error) {
+	var links []AliasLink
+	for i := range cb.Pkgs {
+		p := &cb.Pkgs[i]
+		if len(p.Aliases) == 0 {
+			continue
+		}
+		target, err := cb.PkgWS(p)
+		if err != nil {
+			return nil, err
+		}
+		for alias, link := range p.Aliases {
+			link = path.Clean(strings.TrimPrefix(filepath.ToSlash(link), "/"))
+			if link == target || link == "." {
+				continue
+			}
+			if outsideWkspc(link) {
+				return nil, out.NewErrf(3023, "Alias \"%s\" of pkg \"%s\" is outside the workspace root: %s", alias, p.Name, link)
+			}
+			links = append(links, AliasLink{Pkg: p.Name, Alias: alias, Link: link, Target: target})
+		}
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].Link < links[j].Link })
+	return links, nil
+}
+
+// aliasState returns the state of the given alias symlink in the given
+// workspace root dir
+func aliasState(wkspcRoot string, link AliasLink) AliasState {
+	linkPath := filepath.Join(wkspcRoot, filepath.FromSlash(link.Link))
+	fi, err := os.Lstat(linkPath)
+	switch {
+	case err != nil:
+		return AliasMissing
+	case fi.Mode()&os.ModeSymlink == 0:
+		return AliasConflict
+	}
+	dest, err := os.Readlink(linkPath)
+	if err != nil {
+		return AliasWrongTarget
+	}
+	if !filepath.IsAbs(dest) {
+		dest = filepath.Join(filepath.Dir(linkPath), dest)
+	}
+	if filepath.Clean(dest) != filepath.Join(wkspcRoot, filepath.FromSlash(link.Target)) {
+		return AliasWrongTarget
+	}
+	return AliasOK
+}
+
+// CheckAliases returns the state of each of the codebase alias symlinks
+// (see AliasLinks()) in the given workspace root dir
+func (cb *Defn) CheckAliases(wkspcRoot string) ([]AliasStatus, error) {
+	links, err := cb.AliasLinks()
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]AliasStatus, 0, len(links))
+	for _, link := range links {
+		statuses = append(statuses, AliasStatus{AliasLink: link, State: aliasState(wkspcRoot, link)})
+	}
+	return statuses, nil
+}
+
+// SyncAliases brings the alias symlinks in the given workspace root dir in
+// line with the codebase, if the "linkalias" attr is set missing symlinks
+// are created and those linking elsewhere are relinked (relative symlinks
+// are used so the workspace can be moved), if not set any alias symlinks
+// are removed (see CleanAliases()).  Real files or dirs at an alias path
+// are never touched, the other symlinks are still synced and these are
+// then reported as conflicts (error 3023).
+func (cb *Defn) SyncAliases(wkspcRoot string) error {
+	if !cb.LinkAliases() {
+		return cb.CleanAliases(wkspcRoot)
+	}
+	statuses, err := cb.CheckAliases(wkspcRoot)
+	if err != nil {
+		return err
+	}
+	var conflicts []string
+	for _, status := range statuses {
+		linkPath := filepath.Join(wkspcRoot, filepath.FromSlash(status.Link))
+		switch status.State {
+		case AliasOK:
+			continue
+		case AliasConflict:
+			conflicts = append(conflicts, "  "+status.Link+" (alias \""+status.Alias+"\" of pkg \""+status.Pkg+"\")")
+			continue
+		case AliasWrongTarget:
+			if err = os.Remove(linkPath); err != nil {
+				return out.WrapErrf(err, 3023, "Unable to relink alias \"%s\" of pkg \"%s\"", status.Alias, status.Pkg)
+			}
+		}
+		dest, err := filepath.Rel(filepath.Dir(linkPath), filepath.Join(wkspcRoot, filepath.FromSlash(status.Target)))
+		if err == nil {
+			err = os.MkdirAll(filepath.Dir(linkPath), 0755)
+		}
+		if err == nil {
+			err = os.Symlink(dest, linkPath)
+		}
+		if err != nil {
+			return out.WrapErrf(err, 3023, "Unable to link alias \"%s\" of pkg \"%s\"", status.Alias, status.Pkg)
+		}
+	}
+	if len(conflicts) != 0 {
+		return out.NewErrf(3023, "Alias links conflict with existing workspace files or dirs:\n%s", strings.Join(conflicts, "\n"))
+	}
+	return nil
+}
+
+// CleanAliases removes the codebase alias symlinks (whatever they link to)
+// from the given workspace root dir along with any dirs left empty by that
+// (up to the workspace root), real files or dirs at alias paths are left
+func (cb *Defn) CleanAliases(wkspcRoot string) error {
+	links, err := cb.AliasLinks()
+	if err != nil {
+		return err
+	}
+	for _, link := range links {
+		linkPath := filepath.Join(wkspcRoot, filepath.FromSlash(link.Link))
+		if fi, err := os.Lstat(linkPath); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		if err = os.Remove(linkPath); err != nil {
+			return out.WrapErrf(err, 3023, "Unable to remove link for alias \"%s\" of pkg \"%s\"", link.Alias, link.Pkg)
+		}
+		root := filepath.Clean(wkspcRoot)
+		for dir := filepath.Dir(linkPath); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+			if os.Remove(dir) != nil {
+				break
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+// Copyright © 2015 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codebase
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dvln/out"
+)
+
+func TestAliasLinks(t *testing.T) {
+	codebaseDefn := New()
+	if err := codebaseDefn.Read(bytes.NewReader(codebaseExample)); err != nil {
+		t.Fatalf("Read of the codebase failed: %s", err)
+	}
+	if !codebaseDefn.LinkAliases() {
+		t.Fatalf("The example codebase should have linkalias set")
+	}
+	links, err := codebaseDefn.AliasLinks()
+	if err != nil {
+		t.Fatalf("Alias links failed: %s", err)
+	}
+	found := false
+	for _, link := range links {
+		if link.Link == "src/dvln/lib/olddir/viper" {
+			found = true
+			if link.Pkg != "dvln/lib/3rd/viper" || link.Target != "src/dvln/lib/3rd/viper" {
+				t.Errorf("Unexpected alias link for the old viper dir: %+v", link)
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("Expected an alias link for the old viper dir, found: %+v", links)
+	}
+}
+
+func TestSyncAliases(t *testing.T) {
+	dir, err := ioutil.TempDir("", "codebase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	codebaseDefn := New()
+	if err = codebaseDefn.Read(bytes.NewReader(codebaseExample)); err != nil {
+		t.Fatalf("Read of the codebase failed: %s", err)
+	}
+	links, err := codebaseDefn.AliasLinks()
+	if err != nil {
+		t.Fatalf("Alias links failed: %s", err)
+	}
+	checkStates := func(desc string, expected map[string]AliasState) {
+		statuses, err := codebaseDefn.CheckAliases(dir)
+		if err != nil || len(statuses) != len(links) {
+			t.Fatalf("%s: alias check failed: %v", desc, err)
+		}
+		for _, status := range statuses {
+			state, ok := expected[status.Link]
+			if !ok {
+				state = expected[""]
+			}
+			if status.State != state {
+				t.Errorf("%s: expected alias %s state %d, found: %d", desc, status.Link, state, status.State)
+			}
+		}
+	}
+	checkStates("empty workspace", map[string]AliasState{"": AliasMissing})
+
+	// a real dir at an alias path is a conflict, the other links are made
+	conflict := filepath.Join(dir, "src", "dvln", "reallyolddir", "viper")
+	if err = os.MkdirAll(conflict, 0755); err != nil {
+		t.Fatal(err)
+	}
+	err = codebaseDefn.SyncAliases(dir)
+	if !out.IsError(err, nil, 3023) || !strings.Contains(err.Error(), "src/dvln/reallyolddir/viper") {
+		t.Fatalf("Expected the real dir to be reported as a conflict (3023), found: %v", err)
+	}
+	checkStates("synced", map[string]AliasState{"": AliasOK, "src/dvln/reallyolddir/viper": AliasConflict})
+	dest, err := os.Readlink(filepath.Join(dir, "src", "dvln", "lib", "olddir", "viper"))
+	if err != nil || dest != filepath.Join("..", "3rd", "viper") {
+		t.Fatalf("Expected a relative link to the viper pkg, found: %q (%v)", dest, err)
+	}
+
+	// links elsewhere are relinked
+	oldout := filepath.Join(dir, "src", "dvln", "lib", "oldoutname")
+	os.Remove(oldout)
+	if err = os.Symlink("elsewhere", oldout); err != nil {
+		t.Fatal(err)
+	}
+	checkStates("bad link", map[string]AliasState{"": AliasOK, "src/dvln/reallyolddir/viper": AliasConflict, "src/dvln/lib/oldoutname": AliasWrongTarget})
+	os.Remove(conflict)
+	if err = codebaseDefn.SyncAliases(dir); err != nil {
+		t.Fatalf("Sync of the aliases failed: %s", err)
+	}
+	checkStates("resynced", map[string]AliasState{"": AliasOK})
+
+	// without linkalias they're cleaned up, empty dirs too
+	if err = os.MkdirAll(filepath.Join(dir, "src", "dvln", "lib", "3rd", "viper"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	codebaseDefn.Attrs["linkalias"] = "False"
+	if err = codebaseDefn.SyncAliases(dir); err != nil {
+		t.Fatalf("Clean of the aliases failed: %s", err)
+	}
+	checkStates("cleaned", map[string]AliasState{"": AliasMissing})
+	if _, err = os.Stat(filepath.Join(dir, "src", "dvln", "reallyolddir")); !os.IsNotExist(err) {
+		t.Fatalf("Expected dirs emptied by the clean to be removed, found: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "src", "dvln", "lib", "3rd", "viper")); err != nil {
+		t.Fatalf("Expected the pkg dir to be left, found: %v", err)
+	}
+}
+
+func TestAliasLinksOutside(t *testing.T) {
+	codebaseDefn := New()
+	if err := codebaseDefn.Read(bytes.NewReader(codebaseExample)); err != nil {
+		t.Fatalf("Read of the codebase failed: %s", err)
+	}
+	codebaseDefn.Pkgs[0].Aliases = map[string]string{"escaped": "src/../../escaped"}
+	_, err := codebaseDefn.AliasLinks()
+	if !out.IsError(err, nil, 3023) || !strings.Contains(err.Error(), codebaseDefn.Pkgs[0].Name) {
+		t.Fatalf("Alias paths outside the workspace should fail (3023) noting the pkg, found: %v", err)
+	}
+	dir, err := ioutil.TempDir("", "codebase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wkspc := filepath.Join(dir, "wkspc")
+	if err = codebaseDefn.SyncAliases(wkspc); !out.IsError(err, nil, 3023) {
+		t.Fatalf("Alias sync with an alias outside the workspace should fail (3023), found: %v", err)
+	}
+	if _, err = os.Lstat(filepath.Join(dir, "escaped")); !os.IsNotExist(err) {
+		t.Fatalf("No alias link should be made outside the workspace: %v", err)
+	}
+}
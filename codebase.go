@@ -14,23 +14,30 @@
 // Package codebase works with 'dvln' code bases.  This typically means
 // getting, pulling/updating, reading and writingcodebase definitions or
 // handling situations where one is defined dynamically.  Currently this
-// is focused on a JSON definition for the codebase file.
+// is focused on a JSON definition for the codebase file, TOML and YAML
+// codebase files can also be read and written (see ReadTOML, WriteTOML,
+// ReadYAML and WriteYAML).
 package codebase
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
 	"text/template"
+	"text/template/parse"
 
 	"github.com/dvln/mapstructure"
 	"github.com/dvln/out"
 	"github.com/dvln/pkg"
-	"github.com/dvln/util/file"
-	globs "github.com/dvln/viper"
 )
 
 // Defn is the code base defintion file: what known pkgs are available to
@@ -61,6 +68,7 @@ import (
 //   Issues: optional; URL to codebase level issue tracking sys, Pkg level also
 //   Access: optional; to be fully specified, access control possibilities
 //   Pkgs: details about pkgs for the codebase (pkg definitions, NOT versions)
+//   expansions: where any var expanded fields came from, see Expansions()
 type Defn struct {
 	Name     string  `json:"name"`
 	Desc     string  `json:"desc"`
@@ -75,6 +83,24 @@ type Defn struct {
 	Issues   url.URL                      `json:"issues"`
 	Access   map[string]map[string]string `json:"access,omitempty"`
 	Pkgs     []pkg.Defn                   `json:"pkgs" mapstructure:",squash"`
+
+	expansions map[string]*Expansion
+}
+
+// Expansion records the provenance of a codebase field that had vars
+// expanded into it on Read(), ie: where a given repo URL came from:
+//   Field: which field, one of these forms (<pkg> is the pkg name):
+//          "access[<conditional>]" (the expanded conditional),
+//          "pkgs[<pkg>].vcs[<index>].repo[<access>]" or
+//          "pkgs[<pkg>].vcs[<index>].remotes[<remote>][<access>]"
+//   Template: the field as written in the codebase file, eg: {{.dvln}}/out
+//   Vars: names of the vars used by the template, eg: [ "dvln" ]
+//   Value: the expanded field value, eg: http://github.com/dvln/out
+type Expansion struct {
+	Field    string
+	Template string
+	Vars     []string
+	Value    string
 }
 
 // Locality indicates to the codebase existence checker if a pkg/repo exists
@@ -139,30 +165,69 @@ func (c *Defn) Item(i CodebaseItem) error {
 // - string: URI: full path (on filesystem) or URL (if remote), "" if not found
 // - locality: where it exists (LocalDir, RemoteURL, NonExistent)
 // - error: any error that is detected in scanning for the workspace
+// Note: the codebase path setting is "codebasePath" (DVLN_CODEBASE_PATH
+// is used from the env if not set), remote entries are checked via the
+// Fetcher registered for the URI scheme (host entries, eg: "github.com/dvln",
+// are git repos served over https), after those the "<name>.codebase" (or
+// .json, .toml, .yaml, .yml) file is looked for in any "codebaseDirs"
+// setting dirs, the workspace root and the dvln config dir before the
+// codebase name itself is tried, the not found error lists every location
+// tried.  The codebase version selector is parsed via ParseSelector(), only
+// the location is used to find the codebase (Get() uses the revision).
+// If the "offline" setting is set the network is never used, remote entries
+// only find codebases already in the local codebase caches (these come back
+// as LocalDir cache paths, never RemoteURL's) and, if the codebase is only
+// available remotely, error 3019 lists the remote locations needed.
 func (cb *Defn) Exists(codebaseVerSel string) (string, Locality, error) {
-	//eriknow, make some choices around codebase existence checks...
-	//         should be a challenge, that's for sure
-	var err error
-	exists := false
-	if codebaseVerSel != "" {
-		exists, err = file.Exists(codebaseVerSel)
-	}
-	wkspcRootDir := ""
-	if !exists {
-		wkspcRootDir = globs.GetString("wkspcRootDir")
-	}
-	if wkspcRootDir == "" {
-		wkspcRootDir = globs.GetString("dvlnCfgDir")
-	}
-	if codebaseVerSel == "" || !exists || err != nil {
-		if err == nil {
-			out.Debugln("No codebase file to read, skipping (considered normal)")
-		} else {
-			out.Debugf("No codebase file to read, skipping (abnormal, unexpected err: %s)\n", err)
-		}
+	return cb.ExistsContext(context.Background(), codebaseVerSel)
+}
+
+// ExistsContext is Exists() with a context, the search for the codebase
+// (including any remote existence checks) is given up, with error 3020,
+// once the context is done (cancelled or past its deadline)
+func (cb *Defn) ExistsContext(ctx context.Context, codebaseVerSel string) (string, Locality, error) {
+	if codebaseVerSel == "" {
+		out.Debugln("No codebase file to read, skipping (considered normal)")
+		return "", NonExistent, nil
+	}
+	sel, err := ParseSelector(codebaseVerSel)
+	if err != nil {
 		return "", NonExistent, err
 	}
-	return codebaseVerSel, LocalDir, nil
+	candidates, tried, err := findCodebase(ctx, sel.Location, false)
+	if err != nil {
+		out.Debugf("No codebase file to read, skipping (abnormal, unexpected err: %s)\n", err)
+		return "", NonExistent, err
+	}
+	if len(candidates) == 0 {
+		return "", NonExistent, notFoundErr(codebaseVerSel, tried)
+	}
+	return candidates[0].URI, candidates[0].Locality, nil
+}
+
+// Candidates searches for the codebase just as Exists() does but, rather
+// than stopping at the first, returns every candidate found along the
+// codebase search path (in search path order) so one can see which one
+// wins (the first, what Exists() resolves to) and which ones it shadows.
+// If no candidates are found the error lists every location tried.
+func (cb *Defn) Candidates(codebaseVerSel string) ([]Candidate, error) {
+	return cb.CandidatesContext(context.Background(), codebaseVerSel)
+}
+
+// CandidatesContext is Candidates() with a context, see ExistsContext()
+func (cb *Defn) CandidatesContext(ctx context.Context, codebaseVerSel string) ([]Candidate, error) {
+	sel, err := ParseSelector(codebaseVerSel)
+	if err != nil {
+		return nil, err
+	}
+	candidates, tried, err := findCodebase(ctx, sel.Location, true)
+	if err != nil {
+		return candidates, err
+	}
+	if len(candidates) == 0 {
+		return nil, notFoundErr(codebaseVerSel, tried)
+	}
+	return candidates, nil
 }
 
 func (cb *Defn) applyVarsToField(desc, fieldName, fieldValue string) (string, error) {
@@ -180,6 +245,125 @@ func (cb *Defn) applyVarsToField(desc, fieldName, fieldValue string) (string, er
 	return result, nil
 }
 
+// expandField applies any vars to the given field value (see the
+// applyVarsToField() method) and records the provenance of the field
+func (cb *Defn) expandField(desc, fieldName, field, fieldValue string) (string, error) {
+	result, err := cb.applyVarsToField(desc, fieldName, fieldValue)
+	if err != nil {
+		return "", err
+	}
+	cb.recordExpansion(field, fieldValue, result)
+	return result, nil
+}
+
+// recordExpansion notes the template a field was expanded from, if any
+func (cb *Defn) recordExpansion(field, template, result string) {
+	if result == template {
+		return
+	}
+	if cb.expansions == nil {
+		cb.expansions = make(map[string]*Expansion)
+	}
+	cb.expansions[field] = &Expansion{
+		Field:    field,
+		Template: template,
+		Vars:     templateVars(template),
+		Value:    result,
+	}
+}
+
+// templateVars returns the (sorted) var names used in the given template,
+// ie: "{{.dvln}}/viper" uses the "dvln" var
+func templateVars(fieldValue string) []string {
+	trees, err := parse.Parse("vars", fieldValue, "", "")
+	if err != nil {
+		return nil
+	}
+	found := make(map[string]bool)
+	var walk func(node parse.Node)
+	walk = func(node parse.Node) {
+		switch n := node.(type) {
+		case *parse.ListNode:
+			if n != nil {
+				for _, kid := range n.Nodes {
+					walk(kid)
+				}
+			}
+		case *parse.ActionNode:
+			walk(n.Pipe)
+		case *parse.IfNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.RangeNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.WithNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.PipeNode:
+			if n != nil {
+				for _, cmd := range n.Cmds {
+					walk(cmd)
+				}
+			}
+		case *parse.CommandNode:
+			for _, arg := range n.Args {
+				walk(arg)
+			}
+		case *parse.FieldNode:
+			found[n.Ident[0]] = true
+		}
+	}
+	for _, tree := range trees {
+		walk(tree.Root)
+	}
+	vars := make([]string, 0, len(found))
+	for name := range found {
+		vars = append(vars, name)
+	}
+	sort.Strings(vars)
+	return vars
+}
+
+// Expansions returns the provenance of every field that had vars expanded
+// into it when the codebase was read, sorted by field, see Expansion
+func (cb *Defn) Expansions() []Expansion {
+	expansions := make([]Expansion, 0, len(cb.expansions))
+	for _, e := range cb.expansions {
+		expansions = append(expansions, *e)
+	}
+	sort.Slice(expansions, func(i, j int) bool {
+		return expansions[i].Field < expansions[j].Field
+	})
+	return expansions
+}
+
+// Expansion returns the provenance of the given field (see Expansion for
+// the field forms), false is returned if no vars were expanded into it
+func (cb *Defn) Expansion(field string) (Expansion, bool) {
+	if e, ok := cb.expansions[field]; ok {
+		return *e, true
+	}
+	return Expansion{}, false
+}
+
+// accessField, repoField and remoteField return the Expansion field
+// names used for the various codebase fields that vars can be used in
+func accessField(conditional string) string {
+	return fmt.Sprintf("access[%s]", conditional)
+}
+
+func repoField(pkgName string, vcsIdx int, access string) string {
+	return fmt.Sprintf("pkgs[%s].vcs[%d].repo[%s]", pkgName, vcsIdx, access)
+}
+
+func remoteField(pkgName string, vcsIdx int, remName, access string) string {
+	return fmt.Sprintf("pkgs[%s].vcs[%d].remotes[%s][%s]", pkgName, vcsIdx, remName, access)
+}
+
 // expandVarUse basically takes any variables (Vars) defined in the
 // codebase definition file in a codebase wide section like this:
 //   ...
@@ -220,6 +404,7 @@ func (cb *Defn) applyVarsToField(desc, fieldName, fieldValue string) (string, er
 // remotes" and "repo" related codebase fields (currently only place that
 // var's can be used):
 func (cb *Defn) expandVarUse() error {
+	cb.expansions = nil
 	// Deal with the codebase level access conditional here, expanding any
 	// vars used in templates there
 	for conditional, accessMap := range cb.Access {
@@ -231,16 +416,17 @@ func (cb *Defn) expandVarUse() error {
 		if result != conditional {
 			cb.Access[result] = accessMap
 			delete(cb.Access, conditional)
+			cb.recordExpansion(accessField(result), conditional, result)
 		}
 	}
 
 	// Deal with package settings that can use vars in templates here:
 	for _, pkg := range cb.Pkgs {
-		for _, vcs := range pkg.VCS {
+		for i, vcs := range pkg.VCS {
 			// first deal with any repo settings using vars
 			for access, repoURI := range vcs.Repo {
 				desc := fmt.Sprintf("  Pkg: %s\n  VCS: %s\n  Tgt: %s", pkg.Name, vcs.Type, access)
-				result, err := cb.applyVarsToField(desc, "repoURI", repoURI)
+				result, err := cb.expandField(desc, "repoURI", repoField(pkg.Name, i, access), repoURI)
 				if err != nil {
 					return err
 				}
@@ -250,7 +436,7 @@ func (cb *Defn) expandVarUse() error {
 			for remName, remURLMap := range vcs.Remotes {
 				for access, repoURI := range remURLMap {
 					desc := fmt.Sprintf("  Pkg: %s\n  VCS: %s\n  Remote: %s\nTgt: %s", pkg.Name, vcs.Type, remName, access)
-					result, err := cb.applyVarsToField(desc, "remoteURI", repoURI)
+					result, err := cb.expandField(desc, "remoteURI", remoteField(pkg.Name, i, remName, access), repoURI)
 					if err != nil {
 						return err
 					}
@@ -264,18 +450,31 @@ func (cb *Defn) expandVarUse() error {
 
 // Read will, given an io.Reader, attempt to scan in the codebase contents
 // and "fill out" the given Defn structure for you.  What could
-// go wrong?  If anything a non-nil error is returned.
+// go wrong?  If anything a non-nil error is returned.  Note that "//" and
+// "/* */" comments are allowed in the JSON (see ReadDoc for keeping them).
 func (cb *Defn) Read(r io.Reader) error {
+	contents, err := ioutil.ReadAll(r)
+	if err != nil {
+		return out.WrapErr(err, "Failed to read codebase JSON", 3001)
+	}
+	// hand maintained codebase files may carry comments, blank them out
+	// (offsets are kept so syntax error offsets still match the file)
 	codebaseMap := make(map[string]interface{})
-	decJSON := json.NewDecoder(r)
-	err := decJSON.Decode(&codebaseMap)
+	decJSON := json.NewDecoder(bytes.NewReader(stripJSONComments(contents)))
+	err = decJSON.Decode(&codebaseMap)
 	if err != nil {
 		if serr, ok := err.(*json.SyntaxError); ok {
 			return out.WrapErrf(err, 3001, "Failed to decode codebase JSON (Bad Char Offset: %v)", serr.Offset)
 		}
 		return out.WrapErr(err, "Failed to decode codebase JSON file", 3001)
 	}
+	return cb.decode(codebaseMap)
+}
 
+// decode will "fill out" the codebase definition from the generic map
+// form of the codebase file (as decoded from JSON, TOML or YAML)
+func (cb *Defn) decode(codebaseMap map[string]interface{}) error {
+	attrBools(codebaseMap)
 	config := &mapstructure.DecoderConfig{
 		WeaklyTypedInput: true,
 		Result:           cb,
@@ -285,8 +484,7 @@ func (cb *Defn) Read(r io.Reader) error {
 		return out.WrapErr(err, "Failed to prepare codebase file decoder", 3002)
 	}
 
-	err = decoder.Decode(codebaseMap)
-	if err != nil {
+	if err = decoder.Decode(codebaseMap); err != nil {
 		return out.WrapErr(err, "Failed to decode codebase file contents", 3003)
 	}
 	// codebase definitions can be reduced in size if the person defining that
@@ -299,15 +497,198 @@ func (cb *Defn) Read(r io.Reader) error {
 	return nil
 }
 
+// varRefs returns the codebase Vars as name/value pairs, longest value
+// first, so the most specific var wins when re-compacting field values
+func (cb *Defn) varRefs() [][2]string {
+	refs := make([][2]string, 0, len(cb.Vars))
+	for name, value := range cb.Vars {
+		if value == "" || !varNameRE.MatchString(name) {
+			continue
+		}
+		refs = append(refs, [2]string{name, value})
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		if len(refs[i][1]) != len(refs[j][1]) {
+			return len(refs[i][1]) > len(refs[j][1])
+		}
+		return refs[i][0] < refs[j][0]
+	})
+	return refs
+}
+
+// varNameRE matches var names that can be referenced as "{{.<var>}}"
+var varNameRE = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// applyVarRefs swaps any var values found in the given field value back
+// to "{{.<var>}}" references, the reverse of applyVarsToField.  The value
+// is scanned once, left to right, using the longest var value matching at
+// each position (see varRefs()), so references already swapped in are
+// never themselves rewritten (eg: by a var whose value is in a var name).
+func applyVarRefs(refs [][2]string, fieldValue string) string {
+	if len(refs) == 0 {
+		return fieldValue
+	}
+	var buf bytes.Buffer
+	for i := 0; i < len(fieldValue); {
+		matched := false
+		for _, ref := range refs {
+			if strings.HasPrefix(fieldValue[i:], ref[1]) {
+				buf.WriteString("{{." + ref[0] + "}}")
+				i += len(ref[1])
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			buf.WriteByte(fieldValue[i])
+			i++
+		}
+	}
+	return buf.String()
+}
+
+// compactVarUse is the reverse of expandVarUse, it returns a copy of the
+// codebase definition where the "access" conditionals and the pkg "repo"
+// and "remotes" settings use the templates they were read with again (if
+// unchanged since Read) or "{{.<var>}}" references wherever a var value
+// is found in them.  The codebase definition itself is left as
+// is (the copy gets its own maps for anything that is adjusted).
+func (cb *Defn) compactVarUse() *Defn {
+	refs := cb.varRefs()
+	compactField := func(field, value string) string {
+		// the original template is used if it still expands to the value
+		if e, ok := cb.expansions[field]; ok && e.Value == value {
+			if result, err := cb.applyVarsToField("", field, e.Template); err == nil && result == value {
+				return e.Template
+			}
+		}
+		return applyVarRefs(refs, value)
+	}
+	compact := *cb
+	if cb.Access != nil {
+		compact.Access = make(map[string]map[string]string, len(cb.Access))
+		for conditional, accessMap := range cb.Access {
+			compact.Access[compactField(accessField(conditional), conditional)] = accessMap
+		}
+	}
+	compact.Pkgs = append(cb.Pkgs[:0:0], cb.Pkgs...)
+	for i := range compact.Pkgs {
+		pkg := &compact.Pkgs[i]
+		pkg.VCS = append(pkg.VCS[:0:0], pkg.VCS...)
+		for j := range pkg.VCS {
+			vcs := &pkg.VCS[j]
+			if vcs.Repo != nil {
+				repo := make(map[string]string, len(vcs.Repo))
+				for access, repoURI := range vcs.Repo {
+					repo[access] = compactField(repoField(pkg.Name, j, access), repoURI)
+				}
+				vcs.Repo = repo
+			}
+			if vcs.Remotes != nil {
+				remotes := make(map[string]map[string]string, len(vcs.Remotes))
+				for remName, remURLMap := range vcs.Remotes {
+					remotes[remName] = make(map[string]string, len(remURLMap))
+					for access, repoURI := range remURLMap {
+						remotes[remName][access] = compactField(remoteField(pkg.Name, j, remName, access), repoURI)
+					}
+				}
+				vcs.Remotes = remotes
+			}
+		}
+	}
+	return &compact
+}
+
 // Write will, given an io.Writer, attempt to write the codebase out to
 // it's local file representation, note that it will take any settings
 // matching a "Var" and "re-compact" it so the "{{.<var>}}" is used for
-// any exact matches in fields that support var expansion.
-func (cb *Defn) Write(r io.Writer) error {
-	//FIXME: erik: make this thing work
+// any exact matches in fields that support var expansion.  Fields that
+// are unchanged since Read() are written with the exact template text
+// they were read with (see Expansions()).
+func (cb *Defn) Write(w io.Writer) error {
+	b, err := cb.encodeJSON()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(b); err != nil {
+		return out.WrapErr(err, "Failed to write codebase JSON", 3007)
+	}
 	return nil
 }
 
+// encodeMap returns the generic map form of the codebase with any var use
+// re-compacted and with any empty settings dropped (see tidyValue()), this
+// is what is written out in all formats
+func (cb *Defn) encodeMap() (map[string]interface{}, error) {
+	b, err := json.Marshal(cb.compactVarUse())
+	if err != nil {
+		return nil, out.WrapErr(err, "Failed to encode codebase", 3006)
+	}
+	codebaseMap := make(map[string]interface{})
+	decJSON := json.NewDecoder(bytes.NewReader(b))
+	decJSON.UseNumber()
+	if err = decJSON.Decode(&codebaseMap); err != nil {
+		return nil, out.WrapErr(err, "Failed to encode codebase", 3006)
+	}
+	tidyValue(codebaseMap)
+	return codebaseMap, nil
+}
+
+// tidyValue drops any null, false or empty (string, map or list) settings
+// from the given generic codebase map value and turns any JSON numbers
+// into int64 or float64 values, recursively, false is returned if the
+// value itself is empty.  Unset settings read back in as they were, this
+// includes unset URL's (eg: "home_page") which are objects of empty and
+// false settings.
+func tidyValue(val interface{}) (interface{}, bool) {
+	switch v := val.(type) {
+	case nil:
+		return nil, false
+	case bool:
+		return v, v
+	case string:
+		return v, v != ""
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i, true
+		}
+		f, _ := v.Float64()
+		return f, true
+	case map[string]interface{}:
+		for key, elem := range v {
+			if elem, ok := tidyValue(elem); ok {
+				v[key] = elem
+			} else {
+				delete(v, key)
+			}
+		}
+		return v, len(v) > 0
+	case []interface{}:
+		for i, elem := range v {
+			v[i], _ = tidyValue(elem)
+		}
+		return v, len(v) > 0
+	}
+	return val, true
+}
+
+// encodeJSON returns the indented JSON encoding of the codebase with any
+// var use re-compacted and empty settings dropped, see Write()
+func (cb *Defn) encodeJSON() ([]byte, error) {
+	codebaseMap, err := cb.encodeMap()
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	encJSON := json.NewEncoder(buf)
+	encJSON.SetEscapeHTML(false)
+	encJSON.SetIndent("", "  ")
+	if err := encJSON.Encode(codebaseMap); err != nil {
+		return nil, out.WrapErr(err, "Failed to encode codebase JSON", 3006)
+	}
+	return buf.Bytes(), nil
+}
+
 // New returns a pointer to a codebase definition, empty at this point, see Get
 // and/or Read
 func New() *Defn {
@@ -316,44 +697,133 @@ func New() *Defn {
 }
 
 // Get basically tries to find, get and read a codebase if it can, it
-// returns a codebase definition and any error's that may have occurred
+// returns a codebase definition and any error's that may have occurred.
+// The codebase version selector (see Selector) picks the revision of the
+// codebase pkg to read the codebase file from, PkgRev is set to the
+// revision (commit id) the codebase file was read from, if known.  Devline
+// selection isn't supported yet, selectors with a devline fail (3024).  The
+// codebase file is fetched via the Fetcher for the scheme of the URI that
+// Exists() resolved the codebase to (see RegisterFetcher()), if in a
+// workspace a codebase in a git repo (remote or local) is also cloned into
+// the workspace (see wkspcClone()).  If there is no codebase (or it can't
+// be found) the "generated" codebase is used, it
+// has a pkg for each VCS clone found in the workspace (if in one).  If no
+// codebase was asked for that is no error, if it wasn't found the error
+// finding it is returned (eg: 3010, or 3019 offline) and the codebase is
+// still the usable generated one, if the generated codebase can't be made
+// either error 3026 is returned (noting both errors) and the codebase
+// isn't usable.
 func (cb *Defn) Get(codebaseVerSel string) error {
-	//eriknow: normally we would do any smart discovery of the code base
-	//         definition file here via 'findCodebase()' or something which
-	//         would be able to get it via local file (support RCS versioned),
-	//         or, more likely, the file is in a git clone with the codebase
-	//         definition in it which may also have devline definitions and
-	//         possibly code as well
-	//         - the name could be a partial or full URL, eg:
-	//           "dvln" or "github.com/dvln/dvln" or "http://github.com/dvln/dvln"
-	//           or "file:://path/to/somefile.json" or "/path/to/somefile.json" or
-	//           might use OS friendly paths like "\path\to\somefile.toml"
-	//         - if we think it's in a VCS we need to bring that clone into the
-	//           workspace if we have a workspace, if we don't have a workspace
-	//           we should bring it into a temp location or into ~/.dvlncfg/codebase/
-	//           or something like that (flattened full path?)... we can "smart local clone"
-	//           this pkg into the workspace with hard links or whatever if later "get" of it
-
-	// normally Exists() would do this part and try and get us a "real" name for the
-	// codebase (full URL/etc... but the name should be simple in the file even if
-	// the "full" name is a URL and such)
-	fileName := fmt.Sprintf("/Users/brady/.dvlncfg/%s.codebase", codebaseVerSel)
-	cbFile, locality, err := cb.Exists(fileName)
+	return cb.GetContext(context.Background(), codebaseVerSel)
+}
+
+// GetContext is Get() with a context, finding and fetching the codebase
+// (including any git commands and http requests) is given up, with error
+// 3020, once the context is done (cancelled or past its deadline)
+func (cb *Defn) GetContext(ctx context.Context, codebaseVerSel string) error {
+	// devlines aren't supported yet, don't quietly read the default one
+	if sel, err := ParseSelector(codebaseVerSel); err == nil && sel.Devline != "" {
+		return out.NewErrf(3024, "Codebase \"%s\": devline selection (\"%s\") isn't supported yet", codebaseVerSel, sel.Devline)
+	}
+	// Exists() finds the codebase, in any of the supported formats, along
+	// the codebase search path (local dirs, codebase pkg repos or remotes)
+	cbURI, locality, err := cb.ExistsContext(ctx, codebaseVerSel)
 	if locality == NonExistent {
-		cb.Name = "generated"
-		cb.Desc = "Dynamically generated development line"
-		return err // note, err may be nil as it's ok for codebase not to exist
-	}
-	//FIXME: erik: normally we would check and see if locality was 'RemoteURL' as well
-	//       and, if so, use the Get() routine to bring it down to our workspace
-	//       if we have one and to a tmp location if not (wsroot should be set
-	//       in viper if we have a workspace, note that if it's nested it may
-	//       be a child workspace root but that should be normal I think, consider)
-	fileContents, err := ioutil.ReadFile(cbFile)
+		// no codebase file, so generate a codebase from the workspace clones
+		if out.IsError(err, nil, 3020) {
+			return err
+		}
+		gerr := cb.generate(ctx)
+		switch {
+		case gerr == nil:
+			return err // note, err is nil if no codebase was asked for (that's ok)
+		case err == nil:
+			return gerr
+		}
+		return out.WrapErrf(gerr, 3026, "Codebase \"%s\" not found and unable to generate a codebase from the workspace\n  Lookup: %s\n  Generate: %s", codebaseVerSel, err, gerr)
+	}
+	// remote git codebases are brought into the codebase cache (see gitCache())
+	// and, like local git codebases, from there into our workspace if we have
+	// one (see wkspcClone(), note that if the workspace is nested it may be a
+	// child workspace root but that should be normal I think)
+	sel, err := ParseSelector(codebaseVerSel)
+	if err != nil {
+		return err
+	}
+	fetcher, err := fetcherFor(cbURI)
+	if err != nil {
+		return err
+	}
+	cbFile, fileContents, rev, err := fetcher.Fetch(ctx, cbURI, sel)
+	if err != nil {
+		return err
+	}
+	repoURI, repoDir, err := codebaseRepo(ctx, fetcher, cbURI)
+	if err == nil && repoDir != "" {
+		err = wkspcClone(ctx, repoURI, repoDir, sel, rev)
+	}
+	if err != nil {
+		return err
+	}
+	err = cb.ReadFormat(bytes.NewReader(fileContents), FormatOf(cbFile, fileContents))
+	if err != nil {
+		return err
+	}
+	cb.PkgRev = pkg.Revision(rev)
+	return nil
+}
+
+// readCodebase reads the codebase file for the selected codebase from the
+// given local codebase location (see the Exists() method), if a specific
+// revision is selected (or the location is a bare repo) the location must
+// be a git repo and the codebase file is read at that revision (HEAD for
+// bare repos).  It returns the codebase file name, the file contents and
+// the revision of the codebase pkg (commit id, "" if not in a git repo).
+func readCodebase(ctx context.Context, location string, sel *Selector) (string, []byte, string, error) {
+	inGit := isGitRepo(location)
+	_, err := os.Stat(filepath.Join(location, ".git"))
+	bare := inGit && err != nil
+	if sel.Revision != "" || bare {
+		if !inGit {
+			return "", nil, "", out.NewErrf(3014, "Codebase \"%s\" revision \"%s\" selected but \"%s\" isn't a git repo", sel.Name, sel.Revision, location)
+		}
+		return readGitCodebase(ctx, location, sel)
+	}
+	cbFile, tried, err := codebaseFile(location, sel.Name)
+	if err != nil {
+		return "", nil, "", err
+	}
+	if cbFile == "" {
+		return "", nil, "", notFoundErr(sel.String(), tried)
+	}
+	contents, err := ioutil.ReadFile(cbFile)
 	if err != nil {
 		msg := fmt.Sprintf("Codebase file \"%s\" read failed\n", cbFile)
-		return out.WrapErr(err, msg, 3000)
+		return "", nil, "", out.WrapErr(err, msg, 3000)
+	}
+	rev := ""
+	if inGit {
+		// a working clone, the codebase file is read as is (any local edits
+		// included) and the pkg revision is whatever is checked out
+		rev, _ = gitRevision(ctx, location, "")
+	}
+	return cbFile, contents, rev, nil
+}
+
+// readGitCodebase reads the codebase file for the selected codebase from
+// the given git repo at the selected revision (HEAD if none selected), it
+// returns the codebase file name, the file contents and the commit id
+func readGitCodebase(ctx context.Context, repo string, sel *Selector) (string, []byte, string, error) {
+	commit, err := gitRevision(ctx, repo, sel.Revision)
+	if err != nil {
+		return "", nil, "", err
+	}
+	cbFile, contents, tried, err := gitCodebaseFile(ctx, repo, commit, sel.Name)
+	if err != nil {
+		return "", nil, "", err
+	}
+	if cbFile == "" {
+		return "", nil, "", notFoundErr(sel.String(), tried)
 	}
-	err = cb.Read(bytes.NewReader(fileContents))
-	return err
+	return cbFile, contents, commit, nil
 }
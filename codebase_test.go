@@ -20,7 +20,11 @@ package codebase
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
@@ -358,11 +362,19 @@ func TestLevels(t *testing.T) {
 */
 
 func TestCodebaseFileRead(t *testing.T) {
-	//eriknow: fix this up, need to write the above jsontemplate to a tmp
-	//         file and then have this routine read that file (?), right
-	//         now this relies upon the 'dvln.codebase' file in my home dir
+	// write the above JSON codebase to a tmp codebase dir and have Get()
+	// find and read it from there
+	dir, err := ioutil.TempDir("", "codebase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = ioutil.WriteFile(filepath.Join(dir, "dvln.codebase"), codebaseExample, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer setGlobs(map[string]interface{}{"codebaseDirs": []string{dir}, "dvlnCfgDir": dir})()
 	codebaseDefn := New()
-	err := codebaseDefn.Get("dvln")
+	err = codebaseDefn.Get("dvln")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -376,6 +388,14 @@ func TestCodebaseFileRead(t *testing.T) {
 	//fmt.Printf("Codebase contents:\n%v", results)
 }
 
+// withoutExpansions returns a copy of the codebase minus the provenance
+// of any var expanded fields
+func withoutExpansions(cb *Defn) Defn {
+	c := *cb
+	c.expansions = nil
+	return c
+}
+
 func TestCodebaseParse(t *testing.T) {
 	b := bytes.NewBuffer(codebaseExample)
 	codebaseDefn := New()
@@ -392,8 +412,9 @@ func TestCodebaseParse(t *testing.T) {
 		t.Fatal("Error reading pre-defined \"expanded\" codebase JSON")
 	}
 	// see if the read/expanded and pre/expanded results match, basically
-	// this checks if the template expansion is working, not much else
-	eq := reflect.DeepEqual(codebaseDefn, expandedDefn)
+	// this checks if the template expansion is working, not much else (the
+	// provenance of expanded fields is only recorded for the read/expanded)
+	eq := reflect.DeepEqual(withoutExpansions(codebaseDefn), withoutExpansions(expandedDefn))
 	if !eq {
 		t.Error("Raw codebase read/expansion failed to match pre-expanded copy")
 		t.Error("Examine the output differences but ignore hash ordering differences,")
@@ -441,3 +462,159 @@ func TestBadCodebaseParse(t *testing.T) {
 		t.Fatal("Failed to match correct error from codebase read, expected 3004")
 	}
 }
+
+// lowerKeys returns the given generic JSON value with all object keys
+// lower cased, recursively
+func lowerKeys(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		lowered := make(map[string]interface{}, len(v))
+		for key, elem := range v {
+			lowered[strings.ToLower(key)] = lowerKeys(elem)
+		}
+		return lowered
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = lowerKeys(elem)
+		}
+	}
+	return val
+}
+
+func TestCodebaseWrite(t *testing.T) {
+	b := bytes.NewBuffer(codebaseExample)
+	codebaseDefn := New()
+	err := codebaseDefn.Read(b)
+	if err != nil {
+		t.Fatalf("Error reading pre-defined codebase JSON: %s", err)
+	}
+	w := new(bytes.Buffer)
+	err = codebaseDefn.Write(w)
+	if err != nil {
+		t.Fatalf("Error writing codebase JSON: %s", err)
+	}
+	// the vars should have been re-compacted into the written output
+	written := w.String()
+	for _, use := range []string{`"{{.dvln}}/viper"`, `"{{.spf13}}/hugo"`, `"m,^{{.dvln}}/*, && Vendor!=True"`} {
+		if !strings.Contains(written, use) {
+			t.Errorf("Written codebase should contain %s but does not", use)
+		}
+	}
+	if strings.Contains(written, `"http://github.com/dvln/viper"`) {
+		t.Error("Written codebase should not contain the expanded viper repo URL")
+	}
+	// the written codebase is the compact input, no unset settings added
+	// (keys are matched as the decoder does, ignoring case)
+	var input, output map[string]interface{}
+	if err = json.Unmarshal(codebaseExample, &input); err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal(w.Bytes(), &output); err != nil {
+		t.Fatalf("Error decoding written codebase JSON: %s\n%s", err, written)
+	}
+	if !reflect.DeepEqual(lowerKeys(input), lowerKeys(output)) {
+		t.Errorf("Written codebase should match the compact input, written:\n%s", written)
+	}
+	// and reading it back in should give the same codebase definition
+	roundTrip := New()
+	err = roundTrip.Read(w)
+	if err != nil {
+		t.Fatalf("Error reading back written codebase JSON: %s\n%s", err, written)
+	}
+	if !reflect.DeepEqual(codebaseDefn, roundTrip) {
+		t.Fatalf("Codebase read/write/read round trip failed to match, written:\n%s", written)
+	}
+	// make sure the write didn't compact the codebase we wrote out
+	if codebaseDefn.Pkgs[0].VCS[0].Repo["rw"] != "http://github.com/dvln/viper" {
+		t.Fatalf("Codebase write should not adjust the codebase, found: %s", codebaseDefn.Pkgs[0].VCS[0].Repo["rw"])
+	}
+}
+
+func TestApplyVarRefs(t *testing.T) {
+	// the "org" var value is in the "dvln" var name, swapped in references
+	// must not be rewritten again
+	cb := New()
+	cb.Vars = map[string]string{"org": "dvln", "dvln": "http://github.com/dvln"}
+	refs := cb.varRefs()
+	tests := map[string]string{
+		"http://github.com/dvln/b":      "{{.dvln}}/b",
+		"http://gitlab.com/dvln/b":      "http://gitlab.com/{{.org}}/b",
+		"http://github.com/dvln/dvln/c": "{{.dvln}}/{{.org}}/c",
+		"nothing/here":                  "nothing/here",
+	}
+	for value, expected := range tests {
+		if found := applyVarRefs(refs, value); found != expected {
+			t.Errorf("Var refs for %q should be %q, found: %q", value, expected, found)
+		}
+	}
+
+	// and so a changed repo is written so it can be read back in
+	if err := cb.decode(map[string]interface{}{"name": "refs", "vars": cb.Vars,
+		"pkgs": []interface{}{map[string]interface{}{"name": "b",
+			"vcs": []interface{}{map[string]interface{}{"type": "git", "repo": map[string]interface{}{"rw": "{{.dvln}}/a"}}}}}}); err != nil {
+		t.Fatal(err)
+	}
+	cb.Pkgs[0].VCS[0].Repo["rw"] = "http://github.com/dvln/b"
+	w := new(bytes.Buffer)
+	if err := cb.Write(w); err != nil {
+		t.Fatalf("Error writing codebase JSON: %s", err)
+	}
+	roundTrip := New()
+	if err := roundTrip.Read(bytes.NewReader(w.Bytes())); err != nil {
+		t.Fatalf("Error reading back written codebase JSON: %s\n%s", err, w.String())
+	}
+	if repo := roundTrip.Pkgs[0].VCS[0].Repo["rw"]; repo != "http://github.com/dvln/b" {
+		t.Fatalf("Expected the changed repo to round trip, found: %s\n%s", repo, w.String())
+	}
+}
+
+func TestCodebaseExpansions(t *testing.T) {
+	b := bytes.NewBuffer(codebaseExample)
+	codebaseDefn := New()
+	err := codebaseDefn.Read(b)
+	if err != nil {
+		t.Fatalf("Error reading pre-defined codebase JSON: %s", err)
+	}
+	e, ok := codebaseDefn.Expansion("pkgs[dvln/lib/3rd/viper].vcs[0].remotes[vendor,spf13][r]")
+	if !ok {
+		t.Fatalf("Expected provenance for the viper vendor remote, found: %v", codebaseDefn.Expansions())
+	}
+	if e.Template != "{{.spf13}}/viper" || e.Value != "http://github.com/spf13/viper" ||
+		!reflect.DeepEqual(e.Vars, []string{"spf13"}) {
+		t.Fatalf("Unexpected provenance for the viper vendor remote: %+v", e)
+	}
+	if _, ok = codebaseDefn.Expansion("access[m,^http://github.com/dvln/*, && Vendor!=True]"); !ok {
+		t.Fatal("Expected provenance for the codebase access conditional")
+	}
+	// 3 pkg repos, 4 pkg remotes and the access conditional used vars
+	if len(codebaseDefn.Expansions()) != 8 {
+		t.Fatalf("Expected 8 var expanded fields, found: %v", codebaseDefn.Expansions())
+	}
+
+	// a var that isn't a prefix can't be guessed from a string match but
+	// the recorded template is used for unchanged fields on write
+	codebaseDefn = New()
+	err = codebaseDefn.Read(strings.NewReader(`{ "name": "x",
+	  "vars": { "host": "github.com", "ext": ".git" },
+	  "pkgs": [ { "name": "a", "vcs": [ { "type": "git", "repo": { "rw": "http://{{.host}}/a{{.ext}}" } } ] } ] }`))
+	if err != nil {
+		t.Fatalf("Error reading codebase JSON: %s", err)
+	}
+	codebaseDefn.Vars["unused"] = "github.com/a"
+	w := new(bytes.Buffer)
+	if err = codebaseDefn.Write(w); err != nil {
+		t.Fatalf("Error writing codebase JSON: %s", err)
+	}
+	if !strings.Contains(w.String(), `"http://{{.host}}/a{{.ext}}"`) {
+		t.Fatalf("Written codebase should restore the original repo template:\n%s", w.String())
+	}
+	// once changed the field is compacted via the var values again
+	codebaseDefn.Pkgs[0].VCS[0].Repo["rw"] = "http://github.com/b.git"
+	w.Reset()
+	if err = codebaseDefn.Write(w); err != nil {
+		t.Fatalf("Error writing codebase JSON: %s", err)
+	}
+	if !strings.Contains(w.String(), `"http://{{.host}}/b{{.ext}}"`) {
+		t.Fatalf("Written codebase should compact the changed repo via vars:\n%s", w.String())
+	}
+}
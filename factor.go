@@ -0,0 +1,171 @@
+// Copyright © 2015 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codebase
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// FactorVars is the reverse of the var expansion done when a codebase is
+// read (see expandVarUse()), given pkg "repo" and "remotes" settings with
+// full URL's it computes a minimal set of Vars covering the URL prefixes
+// they share (see factorPrefixes(), any existing Vars are kept and reused)
+// and rewrites those settings to use "{{.<var>}}" references.  Just as
+// after Read(), the settings keep their expanded URL's in the codebase
+// definition (so it can still be used as is), the references are what is
+// recorded as the templates they were expanded from (see Expansions())
+// and so what Write() writes, keeping the codebase file compact.  The
+// names of any vars added are returned (sorted).
+func (cb *Defn) FactorVars() []string {
+	var urls []string
+	cb.eachURLField(func(field, url string) {
+		urls = append(urls, url)
+	})
+	vars := factorPrefixes(urls, cb.Vars)
+	added := make([]string, 0, len(vars))
+	for name, prefix := range vars {
+		if cb.Vars == nil {
+			cb.Vars = make(map[string]string)
+		}
+		cb.Vars[name] = prefix
+		added = append(added, name)
+	}
+	sort.Strings(added)
+	refs := cb.varRefs()
+	cb.eachURLField(func(field, url string) {
+		// settings that already came from a template keep that template
+		if _, ok := cb.expansions[field]; !ok {
+			cb.recordExpansion(field, applyVarRefs(refs, url), url)
+		}
+	})
+	return added
+}
+
+// eachURLField calls the given func with the Expansion field name (see
+// repoField() and remoteField()) and URL of each pkg "repo" and "remotes"
+// setting in the codebase
+func (cb *Defn) eachURLField(f func(field, url string)) {
+	for _, pkg := range cb.Pkgs {
+		for i, vcs := range pkg.VCS {
+			for access, url := range vcs.Repo {
+				f(repoField(pkg.Name, i, access), url)
+			}
+			for remName, remURLMap := range vcs.Remotes {
+				for access, url := range remURLMap {
+					f(remoteField(pkg.Name, i, remName, access), url)
+				}
+			}
+		}
+	}
+}
+
+// factorPrefixes returns new vars (name to value) for the URL prefixes
+// shared by two or more of the given URL's, the prefix of a URL is all up
+// to the last '/' (eg: "http://github.com/dvln" for the URL
+// "http://github.com/dvln/viper").  The set is kept minimal: prefixes
+// already covered by one of the given existing vars, or by a shorter
+// shared prefix, don't get a var of their own (the URL's using them can
+// use that var).  Vars are named after the last path element of the
+// prefix (eg: "dvln", see varName()).
+func factorPrefixes(urls []string, existing map[string]string) map[string]string {
+	counts := make(map[string]int)
+	for _, url := range urls {
+		if prefix := urlPrefix(url); prefix != "" {
+			counts[prefix]++
+		}
+	}
+	var prefixes []string
+	for prefix, count := range counts {
+		if count > 1 {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		if len(prefixes[i]) != len(prefixes[j]) {
+			return len(prefixes[i]) < len(prefixes[j])
+		}
+		return prefixes[i] < prefixes[j]
+	})
+	var covering []string
+	used := make(map[string]string, len(existing))
+	for name, value := range existing {
+		used[name] = value
+		if value != "" {
+			covering = append(covering, value)
+		}
+	}
+	vars := make(map[string]string)
+	for _, prefix := range prefixes {
+		if coveredBy(prefix, covering) {
+			continue
+		}
+		name := varName(prefix, used)
+		used[name] = prefix
+		vars[name] = prefix
+		covering = append(covering, prefix)
+	}
+	return vars
+}
+
+// coveredBy returns true if the given URL prefix is one of the given
+// prefixes or within one of them (eg: "http://github.com/dvln/lib" is in
+// "http://github.com/dvln")
+func coveredBy(prefix string, prefixes []string) bool {
+	for _, p := range prefixes {
+		p = strings.TrimSuffix(p, "/")
+		if prefix == p || strings.HasPrefix(prefix, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// urlPrefix returns the prefix of the given URL, everything up to the last
+// '/', "" if there isn't more than a scheme (or scp-like host) before it
+func urlPrefix(url string) string {
+	i := strings.LastIndex(url, "/")
+	if i <= 0 {
+		return ""
+	}
+	prefix := url[:i]
+	if strings.HasSuffix(prefix, ":/") || strings.HasSuffix(prefix, ":") {
+		return ""
+	}
+	return prefix
+}
+
+// varNonNameRE matches the runs of characters that can't be in a var name
+var varNonNameRE = regexp.MustCompile(`[^A-Za-z0-9_]+`)
+
+// varName returns a var name for the given URL prefix that isn't already
+// used in the given vars, the last path element of the prefix is used
+// (with any characters that can't be used in var names made '_' and a
+// number added if already used, eg: "dvln", "dvln_2")
+func varName(prefix string, vars map[string]string) string {
+	base := prefix[strings.LastIndexAny(prefix, "/:")+1:]
+	base = strings.Trim(varNonNameRE.ReplaceAllString(base, "_"), "_")
+	if base == "" || (base[0] >= '0' && base[0] <= '9') {
+		base = "url_" + base
+	}
+	name := base
+	for i := 2; ; i++ {
+		if _, ok := vars[name]; !ok {
+			return name
+		}
+		name = fmt.Sprintf("%s_%d", base, i)
+	}
+}
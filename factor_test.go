@@ -0,0 +1,119 @@
+// Copyright © 2015 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codebase
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFactorPrefixes(t *testing.T) {
+	urls := []string{
+		"http://github.com/dvln/viper",
+		"http://github.com/dvln/out",
+		"http://github.com/dvln/lib/3rd/a",
+		"http://github.com/dvln/lib/3rd/b",
+		"ssh://git@host.com/dvln/viper",
+		"ssh://git@host.com/dvln/out",
+		"git@host.com:3rd/lib",
+		"git@host.com:3rd/other",
+		"http://github.com/spf13/viper",
+		"http://github.com/top",
+		"https://single.org/x/y",
+	}
+	vars := factorPrefixes(urls, nil)
+	expected := map[string]string{
+		"dvln":    "http://github.com/dvln",
+		"dvln_2":  "ssh://git@host.com/dvln",
+		"url_3rd": "git@host.com:3rd",
+	}
+	if !reflect.DeepEqual(vars, expected) {
+		t.Fatalf("Expected factored vars:\n%v\nfound:\n%v", expected, vars)
+	}
+
+	// existing vars are reused, new names don't clash with them
+	vars = factorPrefixes(urls, map[string]string{"gh": "http://github.com/", "dvln": "unused"})
+	expected = map[string]string{
+		"dvln_2":  "ssh://git@host.com/dvln",
+		"url_3rd": "git@host.com:3rd",
+	}
+	if !reflect.DeepEqual(vars, expected) {
+		t.Fatalf("Expected factored vars with existing vars:\n%v\nfound:\n%v", expected, vars)
+	}
+}
+
+var expandedCodebase = []byte(`{
+  "name": "expanded",
+  "vars": { "spf13": "http://github.com/spf13" },
+  "pkgs": [
+    {
+      "name": "viper",
+      "vcs": [ {
+        "type": "git",
+        "repo": { "rw": "http://github.com/dvln/viper" },
+        "remotes": { "vendor": { "r": "http://github.com/spf13/viper" } }
+      } ]
+    },
+    {
+      "name": "out",
+      "vcs": [ { "type": "git", "repo": { "rw": "http://github.com/dvln/out" } } ]
+    },
+    {
+      "name": "cast",
+      "vcs": [ { "type": "git", "repo": { "rw": "{{.spf13}}/cast" } } ]
+    }
+  ]
+}`)
+
+func TestFactorVars(t *testing.T) {
+	codebaseDefn := New()
+	if err := codebaseDefn.Read(bytes.NewReader(expandedCodebase)); err != nil {
+		t.Fatalf("Error reading expanded codebase: %s", err)
+	}
+	if added := codebaseDefn.FactorVars(); !reflect.DeepEqual(added, []string{"dvln"}) {
+		t.Fatalf("Expected the dvln var to be added, found: %v", added)
+	}
+	if codebaseDefn.Vars["dvln"] != "http://github.com/dvln" || codebaseDefn.Vars["spf13"] != "http://github.com/spf13" {
+		t.Fatalf("Unexpected factored vars: %v", codebaseDefn.Vars)
+	}
+	// the settings stay expanded, the templates are what's written
+	if codebaseDefn.Pkgs[0].VCS[0].Repo["rw"] != "http://github.com/dvln/viper" {
+		t.Fatalf("Factored settings should keep their URL's: %+v", codebaseDefn.Pkgs[0].VCS[0])
+	}
+	expected := map[string]string{
+		repoField("viper", 0, "rw"):            "{{.dvln}}/viper",
+		remoteField("viper", 0, "vendor", "r"): "{{.spf13}}/viper",
+		repoField("out", 0, "rw"):              "{{.dvln}}/out",
+		repoField("cast", 0, "rw"):             "{{.spf13}}/cast",
+	}
+	for field, template := range expected {
+		if e, ok := codebaseDefn.Expansion(field); !ok || e.Template != template {
+			t.Errorf("Expected %s to use template %s, found: %+v", field, template, e)
+		}
+	}
+	w := new(bytes.Buffer)
+	if err := codebaseDefn.Write(w); err != nil {
+		t.Fatalf("Error writing factored codebase: %s", err)
+	}
+	if strings.Contains(w.String(), "http://github.com/dvln/") {
+		t.Fatalf("Written codebase should use the factored vars:\n%s", w)
+	}
+
+	// nothing more to factor the second time around
+	if added := codebaseDefn.FactorVars(); len(added) != 0 {
+		t.Fatalf("Expected no more vars to be added, found: %v", added)
+	}
+}
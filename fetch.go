@@ -0,0 +1,327 @@
+// Copyright © 2015 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codebase
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dvln/out"
+)
+
+// Fetcher retrieves codebase files from codebase locations, a fetcher is
+// registered for each URI scheme it handles (see RegisterFetcher()) and
+// Get() uses the fetcher for the scheme of the URI that Exists() resolves
+// the codebase to, local paths use the "file" scheme fetcher.
+// Fetchers should give up (with error 3020, see cancelErr()) as soon as
+// they can once the given context is done (cancelled or past a deadline).
+type Fetcher interface {
+	// Exists checks if a codebase (codebase file or codebase pkg repo)
+	// exists at the given URI
+	Exists(ctx context.Context, uri string) (bool, error)
+	// Fetch retrieves the codebase file for the selected codebase from
+	// the given URI, it returns the codebase file name (or URL), the file
+	// contents and the revision of the codebase pkg ("" if not known)
+	Fetch(ctx context.Context, uri string, sel *Selector) (string, []byte, string, error)
+}
+
+// Cacher is implemented by fetchers that keep a local cache of what they
+// fetch, in offline mode (see the "offline" setting) remote codebases can
+// only be found via such a cache
+type Cacher interface {
+	// Cached returns the local path of the cached codebase for the given
+	// URI, "" if it isn't cached, the path is read via the "file" fetcher
+	Cached(uri string) string
+}
+
+var (
+	fetchersMu sync.RWMutex
+	fetchers   = map[string]Fetcher{
+		"file":      fileFetcher{},
+		"git":       gitFetcher{},
+		"ssh":       gitFetcher{},
+		"git+ssh":   gitFetcher{},
+		"git+file":  gitFetcher{},
+		"git+http":  gitFetcher{},
+		"git+https": gitFetcher{},
+		"http":      httpFetcher{},
+		"https":     httpFetcher{},
+	}
+)
+
+// RegisterFetcher registers the fetcher to use for codebase URI's with the
+// given scheme (eg: "https"), replacing any existing fetcher for it, a nil
+// fetcher removes the fetcher for the scheme
+func RegisterFetcher(scheme string, f Fetcher) {
+	fetchersMu.Lock()
+	defer fetchersMu.Unlock()
+	scheme = strings.ToLower(scheme)
+	if f == nil {
+		delete(fetchers, scheme)
+		return
+	}
+	fetchers[scheme] = f
+}
+
+// uriScheme returns the (lower case) scheme of the given codebase URI,
+// "file" is returned for local paths
+func uriScheme(uri string) string {
+	if loc := schemeRE.FindStringIndex(uri); loc != nil {
+		return strings.ToLower(uri[:loc[1]-len("://")])
+	}
+	return "file"
+}
+
+// fetcherFor returns the registered fetcher for the scheme of the given
+// codebase URI, an error is returned if there isn't one
+func fetcherFor(uri string) (Fetcher, error) {
+	fetchersMu.RLock()
+	defer fetchersMu.RUnlock()
+	scheme := uriScheme(uri)
+	if f, ok := fetchers[scheme]; ok {
+		return f, nil
+	}
+	return nil, out.NewErrf(3016, "Unable to fetch codebase \"%s\", no fetcher for URI scheme \"%s\"", uri, scheme)
+}
+
+// cancelErr returns the error used when the given context is done while
+// doing the given work (eg: "git ls-remote ..."), nil if it isn't done
+func cancelErr(ctx context.Context, what string) error {
+	if err := ctx.Err(); err != nil {
+		return out.WrapErrf(err, 3020, "Cancelled: %s", what)
+	}
+	return nil
+}
+
+// remoteURI returns the URI to use for a remote codebase search path entry
+// (or selector), entries starting with a host (eg: "github.com/dvln") are
+// taken to be git repos served over https, ie: "git+https://github.com/dvln",
+// "" is returned for the (reserved) 'hub' and 'hub:<uri>' entries
+func remoteURI(entry string) string {
+	if entry == "hub" || strings.HasPrefix(entry, "hub:") {
+		out.Debugf("Skipping codebase location \"%s\" (dvln hub use is reserved)\n", entry)
+		return ""
+	}
+	if schemeRE.MatchString(entry) {
+		return entry
+	}
+	return "git+https://" + entry
+}
+
+// remoteURIs returns the URI's a codebase can have in a remote codebase
+// search path entry, ie: for the 'dvln' codebase "<entry>/dvln" and then,
+// for git repos, "<entry>/dvln.git" (http entries look for codebase files
+// so the extensions are left to the http fetcher)
+func remoteURIs(entry, name string) []string {
+	uri := remoteURI(entry)
+	if uri == "" {
+		return nil
+	}
+	base := strings.TrimRight(uri, "/") + "/" + name
+	switch uriScheme(base) {
+	case "http", "https":
+		return []string{base}
+	}
+	if strings.HasSuffix(base, ".git") {
+		return []string{base}
+	}
+	return []string{base, base + ".git"}
+}
+
+// fileFetcher fetches codebase files from local dirs and "file://" URL's,
+// see readCodebase() for the details
+type fileFetcher struct{}
+
+func (fileFetcher) Exists(ctx context.Context, uri string) (bool, error) {
+	location, ok := localPath(uri)
+	if !ok {
+		return false, nil
+	}
+	_, err := os.Stat(location)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, out.WrapErrf(err, 3000, "Unable to check codebase location \"%s\"", uri)
+	}
+	return true, nil
+}
+
+func (fileFetcher) Fetch(ctx context.Context, uri string, sel *Selector) (string, []byte, string, error) {
+	location, ok := localPath(uri)
+	if !ok {
+		return "", nil, "", out.NewErrf(3016, "Unable to fetch codebase \"%s\", not a local path", uri)
+	}
+	return readCodebase(ctx, location, sel)
+}
+
+// gitURL returns the URL git uses for a codebase URI, any "git+" scheme
+// prefix is dropped, eg: "git+ssh://host/dvln.git" is "ssh://host/dvln.git"
+func gitURL(uri string) string {
+	if strings.HasPrefix(strings.ToLower(uri), "git+") {
+		return uri[len("git+"):]
+	}
+	return uri
+}
+
+// gitFetcher fetches codebase files from remote git repos ("git", "ssh",
+// "git+ssh", "git+file", "git+http" and "git+https" URI's), the repo is
+// brought into the codebase cache (see gitCache()) and the codebase file
+// is read from there at the selected revision (Get() then clones the
+// codebase pkg into the workspace from the cache, see wkspcClone())
+type gitFetcher struct{}
+
+func (f gitFetcher) Exists(ctx context.Context, uri string) (bool, error) {
+	if offline() {
+		return f.Cached(uri) != "", nil
+	}
+	if _, err := git(ctx, "", "ls-remote", "--quiet", gitURL(uri), "HEAD"); out.IsError(err, nil, 3020) {
+		return false, err
+	} else if err != nil {
+		out.Debugf("Codebase git repo \"%s\" not available: %s\n", uri, err)
+		return false, nil
+	}
+	return true, nil
+}
+
+func (gitFetcher) Fetch(ctx context.Context, uri string, sel *Selector) (string, []byte, string, error) {
+	cacheDir, err := gitCache(ctx, uri, sel)
+	if err != nil {
+		return "", nil, "", err
+	}
+	cbFile, contents, rev, err := readGitCodebase(ctx, cacheDir, sel)
+	if err != nil {
+		return "", nil, "", err
+	}
+	return uri + "/" + cbFile, contents, rev, nil
+}
+
+func (gitFetcher) Cached(uri string) string {
+	if cacheDir := gitCacheDir(uri); cacheDir != "" && isGitRepo(cacheDir) {
+		return cacheDir
+	}
+	return ""
+}
+
+// httpClient is used by the http fetcher, the timeout keeps an unresponsive
+// server from hanging codebase searches
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// httpFiles returns the URL's a codebase file can have for the given http
+// codebase URI, the URI itself if it has a codebase file extension and
+// then the URI with each of the codebase file extensions added
+func httpFiles(uri string) []string {
+	var files []string
+	for _, fileName := range codebaseFileNames(path.Base(uri)) {
+		files = append(files, strings.TrimSuffix(uri, path.Base(uri))+fileName)
+	}
+	return files
+}
+
+// httpFetcher fetches codebase files from web servers ("http" and "https"
+// URI's), codebase files fetched this way have no known revision, they are
+// cached and only revalidated with the server once older than the cache
+// TTL (see codebaseCacheTTL()), if the server can't be reached (or in
+// offline mode) the cached file is used no matter how old it is
+type httpFetcher struct{}
+
+func (httpFetcher) Exists(ctx context.Context, uri string) (bool, error) {
+	cached := loadHTTPCache(uri)
+	if cached != nil && (cached.fresh() || offline()) {
+		return true, nil
+	} else if offline() {
+		return false, nil
+	}
+	for _, fileURL := range httpFiles(uri) {
+		req, err := http.NewRequest("HEAD", fileURL, nil)
+		if err != nil {
+			return false, out.WrapErrf(err, 3015, "Unable to check codebase URL \"%s\"", fileURL)
+		}
+		resp, err := httpClient.Do(req.WithContext(ctx))
+		if cerr := cancelErr(ctx, "check of codebase URL "+fileURL); cerr != nil {
+			if err == nil {
+				resp.Body.Close()
+			}
+			return false, cerr
+		}
+		if err != nil {
+			if cached != nil {
+				out.Debugf("Unable to check codebase URL \"%s\", using cached copy: %s\n", fileURL, err)
+				return true, nil
+			}
+			return false, out.WrapErrf(err, 3015, "Unable to check codebase URL \"%s\"", fileURL)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (httpFetcher) Fetch(ctx context.Context, uri string, sel *Selector) (string, []byte, string, error) {
+	if sel.Revision != "" {
+		return "", nil, "", out.NewErrf(3014, "Codebase \"%s\" revision \"%s\" selected but \"%s\" isn't a git repo", sel.Name, sel.Revision, uri)
+	}
+	cached := loadHTTPCache(uri)
+	if cached != nil && (cached.fresh() || offline()) {
+		out.Debugf("Using cached codebase \"%s\" (fetched %s)\n", cached.URL, cached.Fetched)
+		return cached.URL, cached.contents, "", nil
+	} else if offline() {
+		return "", nil, "", offlineErr(sel.String(), []string{uri})
+	}
+	files := httpFiles(uri)
+	if cached != nil {
+		// the file we have cached is revalidated first
+		for i, fileURL := range files {
+			if fileURL == cached.URL {
+				files = append(append([]string{fileURL}, files[:i]...), files[i+1:]...)
+				break
+			}
+		}
+	}
+	for _, fileURL := range files {
+		fetched, status, err := httpGet(ctx, fileURL, cached)
+		if err != nil {
+			if cached != nil && !out.IsError(err, nil, 3020) {
+				out.Debugf("Using stale cached codebase \"%s\" (fetched %s): %s\n", cached.URL, cached.Fetched, err)
+				return cached.URL, cached.contents, "", nil
+			}
+			return "", nil, "", err
+		}
+		if status == http.StatusNotFound {
+			continue
+		}
+		fetched.save(uri)
+		return fetched.URL, fetched.contents, "", nil
+	}
+	if cached != nil {
+		// gone from the server, so drop it from the cache as well
+		os.RemoveAll(httpCacheDir(uri))
+	}
+	return "", nil, "", notFoundErr(sel.String(), files)
+}
+
+func (httpFetcher) Cached(uri string) string {
+	if loadHTTPCache(uri) == nil {
+		return ""
+	}
+	return filepath.Join(httpCacheDir(uri), "contents")
+}
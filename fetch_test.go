@@ -0,0 +1,225 @@
+// Copyright © 2015 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codebase
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dvln/out"
+	globs "github.com/dvln/viper"
+)
+
+func TestRemoteURIs(t *testing.T) {
+	tests := []struct {
+		entry string
+		uris  []string
+	}{
+		{"github.com/dvln", []string{"git+https://github.com/dvln/dvln", "git+https://github.com/dvln/dvln.git"}},
+		{"git+ssh://host.com/path/to/clones/", []string{"git+ssh://host.com/path/to/clones/dvln", "git+ssh://host.com/path/to/clones/dvln.git"}},
+		{"https://host.com/codebases", []string{"https://host.com/codebases/dvln"}},
+		{"hub", nil},
+		{"hub:http://hub.dvln.org", nil},
+	}
+	for _, test := range tests {
+		if uris := remoteURIs(test.entry, "dvln"); !reflect.DeepEqual(uris, test.uris) {
+			t.Errorf("Remote URIs for %s should be %v, found: %v", test.entry, test.uris, uris)
+		}
+	}
+	if uris := remoteURIs("git://host.com", "dvln.git"); !reflect.DeepEqual(uris, []string{"git://host.com/dvln.git"}) {
+		t.Errorf("Remote URIs for a .git name should only be the name, found: %v", uris)
+	}
+}
+
+func TestGitFetcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "codebase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldCommit, newCommit := testCodebaseRepo(t, filepath.Join(dir, "clones", "dvln"), "dvln.json")
+	testGit(t, dir, "clone", "-q", "--bare", filepath.Join(dir, "clones", "dvln"), filepath.Join(dir, "remote", "dvln.git"))
+	remote := "git+file://" + filepath.ToSlash(filepath.Join(dir, "remote"))
+	defer setGlobs(map[string]interface{}{
+		"codebasePath": remote,
+		"codebaseDirs": []string{},
+		"wkspcRootDir": "",
+		"dvlnCfgDir":   dir,
+	})()
+
+	cbURI, locality, err := New().Exists("dvln")
+	if err != nil || locality != RemoteURL || cbURI != remote+"/dvln" {
+		t.Fatalf("Expected to find the remote dvln repo (git adds the .git), found: %s, %v, %v", cbURI, locality, err)
+	}
+	tests := []struct {
+		sel    string
+		name   string
+		pkgRev string
+	}{
+		{"dvln", "dvln", newCommit},
+		{"dvln@v1", "old", oldCommit},
+		{remote + "/dvln.git@v1", "old", oldCommit},
+	}
+	for _, test := range tests {
+		codebaseDefn := New()
+		if err = codebaseDefn.Get(test.sel); err != nil {
+			t.Fatalf("Get of %s failed: %s", test.sel, err)
+		}
+		if codebaseDefn.Name != test.name || string(codebaseDefn.PkgRev) != test.pkgRev {
+			t.Errorf("Get of %s should have name %s at rev %s, found: %s at %s", test.sel, test.name, test.pkgRev, codebaseDefn.Name, codebaseDefn.PkgRev)
+		}
+	}
+	if err = New().Get("dvln@nope"); !out.IsError(err, nil, 3013) {
+		t.Fatalf("Get of a missing remote revision should fail with error 3013, found: %v", err)
+	}
+	if _, err = New().Candidates("missing"); !out.IsError(err, nil, 3010) || !strings.Contains(err.Error(), remote+"/missing.git") {
+		t.Fatalf("Missing codebase should list the remote URIs tried, found: %v", err)
+	}
+}
+
+func TestHTTPFetcher(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/codebases/dvln.yaml":
+			w.Write(codebaseYAMLExample)
+		case "/broken/dvln.codebase":
+			http.Error(w, "oops", http.StatusInternalServerError)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "codebase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer setGlobs(map[string]interface{}{
+		"codebasePath": srv.URL + "/codebases",
+		"codebaseDirs": []string{},
+		"wkspcRootDir": "",
+		"dvlnCfgDir":   dir,
+	})()
+
+	cbURI, locality, err := New().Exists("dvln")
+	if err != nil || locality != RemoteURL || cbURI != srv.URL+"/codebases/dvln" {
+		t.Fatalf("Expected to find the dvln codebase URL, found: %s, %v, %v", cbURI, locality, err)
+	}
+	for _, sel := range []string{"dvln", srv.URL + "/codebases/dvln.yaml"} {
+		codebaseDefn := New()
+		if err = codebaseDefn.Get(sel); err != nil {
+			t.Fatalf("Get of %s failed: %s", sel, err)
+		}
+		if codebaseDefn.Name != "dvln" || codebaseDefn.PkgRev != "" {
+			t.Errorf("Get of %s should have read the YAML codebase (no rev), found: %s at %q", sel, codebaseDefn.Name, codebaseDefn.PkgRev)
+		}
+	}
+	if err = New().Get("dvln@v1"); !out.IsError(err, nil, 3014) {
+		t.Fatalf("Get of an http codebase revision should fail with error 3014, found: %v", err)
+	}
+	if _, _, _, err = (httpFetcher{}).Fetch(context.Background(), srv.URL+"/broken/dvln", &Selector{Name: "dvln"}); !out.IsError(err, nil, 3015) {
+		t.Fatalf("A server error should fail with error 3015, found: %v", err)
+	}
+}
+
+// memFetcher is a test fetcher serving codebase files from memory
+type memFetcher map[string][]byte
+
+func (m memFetcher) Exists(ctx context.Context, uri string) (bool, error) {
+	_, ok := m[uri]
+	return ok, nil
+}
+
+func (m memFetcher) Fetch(ctx context.Context, uri string, sel *Selector) (string, []byte, string, error) {
+	return uri + ".json", m[uri], "mem1", nil
+}
+
+func TestRegisterFetcher(t *testing.T) {
+	RegisterFetcher("MEM", memFetcher{"mem://codebases/dvln": codebaseExample})
+	defer RegisterFetcher("mem", nil)
+
+	codebaseDefn := New()
+	if err := codebaseDefn.Get("mem://codebases/dvln"); err != nil {
+		t.Fatalf("Get via a registered fetcher failed: %s", err)
+	}
+	if codebaseDefn.Name != "dvln" || codebaseDefn.PkgRev != "mem1" {
+		t.Fatalf("Get via a registered fetcher read the wrong codebase: %s at %s", codebaseDefn.Name, codebaseDefn.PkgRev)
+	}
+	RegisterFetcher("mem", nil)
+	if _, err := fetcherFor("mem://codebases/dvln"); !out.IsError(err, nil, 3016) {
+		t.Fatalf("An unregistered scheme should fail with error 3016, found: %v", err)
+	}
+	if f, _ := fetcherFor("/some/local/dir"); f != (fileFetcher{}) {
+		t.Fatalf("Local paths should use the file fetcher, found: %T", f)
+	}
+}
+
+func TestContextCancel(t *testing.T) {
+	// a server that hangs until the request is given up on
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "codebase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	testCodebaseRepo(t, filepath.Join(dir, "clones", "dvln"), "dvln.codebase")
+	defer setGlobs(map[string]interface{}{
+		"codebasePath": srv.URL + "/codebases",
+		"codebaseDirs": []string{},
+		"wkspcRootDir": "",
+		"dvlnCfgDir":   dir,
+	})()
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, locality, err := New().ExistsContext(ctx, "dvln"); locality != NonExistent || !out.IsError(err, nil, 3020) {
+		t.Fatalf("Exists past its deadline should fail with error 3020, found: %v, %v", locality, err)
+	}
+	if err = New().GetContext(ctx, srv.URL+"/codebases/dvln.json"); !out.IsError(err, nil, 3020) {
+		t.Fatalf("Get past its deadline should fail with error 3020, found: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Cancelled remote checks should not wait on the server, took: %s", elapsed)
+	}
+
+	// git commands and local searches give up too
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	remote := "git+file://" + filepath.ToSlash(filepath.Join(dir, "clones"))
+	if _, _, _, err = (gitFetcher{}).Fetch(cancelled, remote+"/dvln", &Selector{Location: "dvln", Name: "dvln"}); !out.IsError(err, nil, 3020) {
+		t.Fatalf("Cancelled git fetch should fail with error 3020, found: %v", err)
+	}
+	globs.Set("codebasePath", filepath.Join(dir, "clones"))
+	if _, err = New().CandidatesContext(cancelled, "dvln"); !out.IsError(err, nil, 3020) {
+		t.Fatalf("Cancelled codebase search should fail with error 3020, found: %v", err)
+	}
+	if err = New().GetContext(context.Background(), "dvln"); err != nil {
+		t.Fatalf("Get with a live context failed: %s", err)
+	}
+}
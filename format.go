@@ -0,0 +1,144 @@
+// Copyright © 2015 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codebase
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/dvln/out"
+)
+
+// Format identifies the file format a codebase definition is written in
+type Format int
+
+const (
+	// UnknownFormat indicates the codebase file format couldn't be determined
+	UnknownFormat Format = iota
+	// JSONFormat is the original (and default) codebase file format
+	JSONFormat
+	// TOMLFormat for codebase files written in TOML
+	TOMLFormat
+	// YAMLFormat for codebase files written in YAML
+	YAMLFormat
+)
+
+// codebaseFileExts are the codebase file extensions that are recognized,
+// in the order they are looked for when searching for a codebase file
+var codebaseFileExts = []string{".codebase", ".json", ".toml", ".yaml", ".yml"}
+
+// String returns the name of the format, eg: "json"
+func (f Format) String() string {
+	switch f {
+	case JSONFormat:
+		return "json"
+	case TOMLFormat:
+		return "toml"
+	case YAMLFormat:
+		return "yaml"
+	}
+	return "unknown"
+}
+
+// FormatOf determines the format of a codebase file from the file name
+// extension (".json", ".toml", ".yaml" or ".yml") and, for ".codebase"
+// files or any other extension, by sniffing the file contents (see the
+// SniffFormat() routine), JSON is assumed if nothing else fits
+func FormatOf(fileName string, contents []byte) Format {
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".json":
+		return JSONFormat
+	case ".toml":
+		return TOMLFormat
+	case ".yaml", ".yml":
+		return YAMLFormat
+	}
+	if f := SniffFormat(contents); f != UnknownFormat {
+		return f
+	}
+	return JSONFormat
+}
+
+var (
+	// tomlLineRE matches a TOML "key = value" setting or "[table]" header
+	tomlLineRE = regexp.MustCompile(`^(\[[^\]]*\]|("[^"]*"|'[^']*'|[A-Za-z0-9_.-]+)\s*=)`)
+	// yamlLineRE matches a YAML "key: value" setting or "- entry" item
+	yamlLineRE = regexp.MustCompile(`^(---|-\s|("[^"]*"|'[^']*'|[A-Za-z0-9_.-]+)\s*:(\s|$))`)
+)
+
+// SniffFormat examines codebase file contents to determine the format,
+// it goes by the first line that isn't blank or a comment, ie: a JSON
+// object start, a TOML setting or table or a YAML setting or document
+// start, if nothing matches UnknownFormat is returned
+func SniffFormat(contents []byte) Format {
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	inComment := false
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if inComment {
+			if i := strings.Index(line, "*/"); i >= 0 {
+				inComment = false
+				line = strings.TrimSpace(line[i+2:])
+			}
+		}
+		if strings.HasPrefix(line, "/*") {
+			inComment = !strings.Contains(line[2:], "*/")
+			continue
+		}
+		switch {
+		case inComment || line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//"):
+			continue
+		case strings.HasPrefix(line, "{"):
+			return JSONFormat
+		case tomlLineRE.MatchString(line):
+			return TOMLFormat
+		case yamlLineRE.MatchString(line):
+			return YAMLFormat
+		}
+		return UnknownFormat
+	}
+	return UnknownFormat
+}
+
+// ReadFormat will, given an io.Reader, attempt to scan in the codebase
+// contents in the given format, see Read(), ReadTOML() and ReadYAML()
+func (cb *Defn) ReadFormat(r io.Reader, f Format) error {
+	switch f {
+	case JSONFormat:
+		return cb.Read(r)
+	case TOMLFormat:
+		return cb.ReadTOML(r)
+	case YAMLFormat:
+		return cb.ReadYAML(r)
+	}
+	return out.NewErrf(3009, "Unable to read codebase, unsupported format: %s", f)
+}
+
+// WriteFormat will, given an io.Writer, attempt to write the codebase out
+// in the given format, see Write(), WriteTOML() and WriteYAML()
+func (cb *Defn) WriteFormat(w io.Writer, f Format) error {
+	switch f {
+	case JSONFormat:
+		return cb.Write(w)
+	case TOMLFormat:
+		return cb.WriteTOML(w)
+	case YAMLFormat:
+		return cb.WriteYAML(w)
+	}
+	return out.NewErrf(3009, "Unable to write codebase, unsupported format: %s", f)
+}
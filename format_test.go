@@ -0,0 +1,60 @@
+// Copyright © 2015 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codebase
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFormatOf(t *testing.T) {
+	tests := []struct {
+		fileName string
+		contents []byte
+		format   Format
+	}{
+		{"dvln.json", codebaseTOMLExample, JSONFormat},
+		{"dvln.toml", nil, TOMLFormat},
+		{"dvln.YML", nil, YAMLFormat},
+		{"dvln.codebase", codebaseExample, JSONFormat},
+		{"dvln.codebase", commentedCodebase, JSONFormat},
+		{"dvln.codebase", codebaseTOMLExample, TOMLFormat},
+		{"dvln.codebase", []byte("# dvln codebase\n[attrs]\njobs = \"4\"\n"), TOMLFormat},
+		{"dvln.codebase", codebaseYAMLExample, YAMLFormat},
+		{"dvln.codebase", []byte("/* dvln\n   codebase */\n---\nname: dvln\n"), YAMLFormat},
+		{"dvln.codebase", []byte("???"), JSONFormat},
+		{"dvln.codebase", nil, JSONFormat},
+	}
+	for _, test := range tests {
+		if f := FormatOf(test.fileName, test.contents); f != test.format {
+			t.Errorf("Format of %s (%.20q) should be %s, found: %s", test.fileName, test.contents, test.format, f)
+		}
+	}
+}
+
+func TestReadFormat(t *testing.T) {
+	for _, contents := range [][]byte{codebaseExample, codebaseTOMLExample, codebaseYAMLExample} {
+		codebaseDefn := New()
+		err := codebaseDefn.ReadFormat(bytes.NewReader(contents), FormatOf("dvln.codebase", contents))
+		if err != nil {
+			t.Fatalf("Error reading codebase: %s", err)
+		}
+		if codebaseDefn.Name != "dvln" || codebaseDefn.Pkgs[0].VCS[0].Repo["rw"] != "http://github.com/dvln/viper" {
+			t.Fatalf("Codebase read via detected format not read correctly: %+v", codebaseDefn)
+		}
+	}
+	if err := New().ReadFormat(bytes.NewReader(codebaseExample), UnknownFormat); err == nil {
+		t.Fatal("Reading a codebase in an unknown format should fail")
+	}
+}
@@ -0,0 +1,286 @@
+// Copyright © 2015 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codebase
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dvln/out"
+	globs "github.com/dvln/viper"
+)
+
+// generate fills in the codebase definition as the "generated" codebase,
+// a dynamic development line made up of the VCS clones found in the
+// workspace (see fromClones()), it has no pkgs if not in a workspace
+func (cb *Defn) generate(ctx context.Context) error {
+	cb.Name = "generated"
+	cb.Desc = "Dynamically generated development line"
+	wkspcDir := globs.GetString("wkspcRootDir")
+	if wkspcDir == "" {
+		return cb.decode(map[string]interface{}{"name": cb.Name, "desc": cb.Desc})
+	}
+	return cb.fromClones(ctx, wkspcDir)
+}
+
+// FromWorkspace generates a codebase definition from the git and hg clones
+// found in the given dir tree (eg: an existing multi-repo checkout) so it
+// can be written out as a codebase file, see FromWorkspaceContext()
+func FromWorkspace(root string) (*Defn, error) {
+	return FromWorkspaceContext(context.Background(), root)
+}
+
+// FromWorkspaceContext is FromWorkspace() with a context, the scan of the
+// dir tree is given up, with error 3020, once the context is done.  The
+// codebase is named after the dir, each clone is a pkg named after the
+// clone path relative to the dir (also the pkg workspace path) with the
+// repo and remotes from the clone (see gitVCS() and hgVCS()) and common
+// repo URL prefixes are factored out into Vars (see FactorVars()) so the
+// written codebase file is compact (the URL's are expanded as usual).
+func FromWorkspaceContext(ctx context.Context, root string) (*Defn, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, out.WrapErrf(err, 3021, "Unable to scan workspace \"%s\" for clones", root)
+	}
+	cb := New()
+	cb.Name = filepath.Base(abs)
+	cb.Desc = "Generated from the clones in " + abs
+	if err = cb.fromClones(ctx, abs); err != nil {
+		return nil, err
+	}
+	return cb, nil
+}
+
+// fromClones fills in the codebase pkgs from the VCS clones found in the
+// given dir (see scanClones()), the codebase is decoded just as if it was
+// read from a codebase file and then vars are factored out of the repo
+// URL's (see FactorVars()) so the codebase is compact when written
+func (cb *Defn) fromClones(ctx context.Context, root string) error {
+	pkgs, err := scanClones(ctx, root)
+	if err != nil {
+		return err
+	}
+	err = cb.decode(map[string]interface{}{"name": cb.Name, "desc": cb.Desc, "pkgs": pkgs})
+	if err != nil {
+		return err
+	}
+	cb.FactorVars()
+	return nil
+}
+
+// skipDirs are dirs that are never scanned for VCS clones, these are VCS
+// metadata dirs and the workspace dvln dir (see wkspcCodebaseDir())
+var skipDirs = map[string]bool{".git": true, ".hg": true, ".dvln": true}
+
+// cloneVCS identifies VCS clones by their VCS metadata dir, each has the
+// routine that returns the VCS settings for such a clone
+var cloneVCS = []struct {
+	metaDir string
+	vcs     func(ctx context.Context, dir string) (map[string]interface{}, error)
+}{
+	{".git", gitVCS},
+	{".hg", hgVCS},
+}
+
+// findClones walks the given dir tree looking for VCS clones (clones may be
+// nested within other clones), clones are identified by their VCS metadata
+// dir only (see cloneVCS), returning the path of each clone found relative
+// to the given dir (in forward slash form) in walk order
+func findClones(ctx context.Context, root string) ([]string, error) {
+	var clones []string
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return out.WrapErrf(err, 3021, "Unable to scan workspace \"%s\" for clones", root)
+		}
+		if cerr := cancelErr(ctx, "scan of workspace "+root); cerr != nil {
+			return cerr
+		}
+		if !fi.IsDir() {
+			return nil
+		}
+		if skipDirs[fi.Name()] && path != root {
+			return filepath.SkipDir
+		}
+		for _, clone := range cloneVCS {
+			if _, err = os.Stat(filepath.Join(path, clone.metaDir)); err != nil {
+				continue
+			}
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return out.WrapErrf(err, 3021, "Unable to scan workspace \"%s\" for clones", root)
+			}
+			clones = append(clones, filepath.ToSlash(rel))
+			break
+		}
+		return nil
+	})
+	return clones, err
+}
+
+// scanClones finds the VCS clones in the given dir tree (see findClones()),
+// returning a pkg (in codebase file map form) for each clone found in walk
+// order, the pkg name and workspace path are the clone path relative to
+// the given dir and the VCS settings come from the clone.  If the given
+// dir is itself a clone its pkg is named after the dir (its workspace path
+// is ".").
+func scanClones(ctx context.Context, root string) ([]interface{}, error) {
+	clones, err := findClones(ctx, root)
+	if err != nil {
+		return nil, err
+	}
+	pkgs := make([]interface{}, 0, len(clones))
+	for _, rel := range clones {
+		name := rel
+		if rel == "." {
+			abs, err := filepath.Abs(root)
+			if err != nil {
+				return nil, out.WrapErrf(err, 3021, "Unable to scan workspace \"%s\" for clones", root)
+			}
+			name = filepath.Base(abs)
+		}
+		path := filepath.Join(root, filepath.FromSlash(rel))
+		var vcsList []interface{}
+		for _, clone := range cloneVCS {
+			if _, err = os.Stat(filepath.Join(path, clone.metaDir)); err != nil {
+				continue
+			}
+			vcs, err := clone.vcs(ctx, path)
+			if err != nil {
+				return nil, err
+			}
+			vcsList = append(vcsList, vcs)
+		}
+		pkgs = append(pkgs, map[string]interface{}{
+			"name": name,
+			"ws":   rel,
+			"vcs":  vcsList,
+		})
+	}
+	return pkgs, nil
+}
+
+// gitVCS returns the VCS settings (in codebase file map form) for the git
+// clone in the given dir, the "origin" remote is the repo and any other
+// remotes are the remotes, see remoteAccess() for the access keys used
+func gitVCS(ctx context.Context, dir string) (map[string]interface{}, error) {
+	// exits non-zero if there are no remotes, so only a cancel is an error
+	config, err := git(ctx, dir, "config", "--local", "--get-regexp", `^remote\..*\.(url|pushurl)$`)
+	if out.IsError(err, nil, 3020) {
+		return nil, err
+	}
+	urls := make(map[string]map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(config)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		key := strings.TrimPrefix(fields[0], "remote.")
+		i := strings.LastIndex(key, ".")
+		name, kind := key[:i], key[i+1:]
+		if urls[name] == nil {
+			urls[name] = make(map[string]string)
+		}
+		urls[name][kind] = fields[1]
+	}
+	vcs := map[string]interface{}{"type": "git"}
+	remotes := make(map[string]interface{})
+	for name, remote := range urls {
+		if name == "origin" {
+			vcs["repo"] = remoteAccess(remote["url"], remote["pushurl"])
+		} else {
+			remotes[name] = remoteAccess(remote["url"], remote["pushurl"])
+		}
+	}
+	if len(remotes) != 0 {
+		vcs["remotes"] = remotes
+	}
+	return vcs, nil
+}
+
+// remoteAccess returns the access map for a repo or remote with the given
+// fetch and push URL's, ie: {"rw": <url>} if they are the same (or there's
+// no push URL) and {"r": <url>, "w": <push url>} if not
+func remoteAccess(fetchURL, pushURL string) map[string]interface{} {
+	if pushURL == "" || pushURL == fetchURL {
+		return map[string]interface{}{"rw": fetchURL}
+	}
+	access := map[string]interface{}{"w": pushURL}
+	if fetchURL != "" {
+		access["r"] = fetchURL
+	}
+	return access
+}
+
+// hgVCS returns the VCS settings (in codebase file map form) for the hg
+// clone in the given dir, these come from the "[paths]" in the clone's
+// hgrc file, the "default" path is the repo and any other paths are the
+// remotes ("default-push" and "<path>:pushurl" give push URL's)
+func hgVCS(ctx context.Context, dir string) (map[string]interface{}, error) {
+	vcs := map[string]interface{}{"type": "hg"}
+	hgrc, err := ioutil.ReadFile(filepath.Join(dir, ".hg", "hgrc"))
+	if os.IsNotExist(err) {
+		return vcs, nil
+	} else if err != nil {
+		return nil, out.WrapErrf(err, 3021, "Unable to read hg clone settings in \"%s\"", dir)
+	}
+	paths := make(map[string]map[string]string)
+	setPath := func(name, kind, url string) {
+		if paths[name] == nil {
+			paths[name] = make(map[string]string)
+		}
+		paths[name][kind] = url
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(hgrc))
+	inPaths := false
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";"):
+			continue
+		case strings.HasPrefix(line, "["):
+			inPaths = line == "[paths]"
+			continue
+		}
+		i := strings.Index(line, "=")
+		if !inPaths || i < 0 {
+			continue
+		}
+		name, url := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		switch {
+		case name == "default-push":
+			setPath("default", "pushurl", url)
+		case strings.HasSuffix(name, ":pushurl"):
+			setPath(strings.TrimSuffix(name, ":pushurl"), "pushurl", url)
+		case !strings.Contains(name, ":"):
+			setPath(name, "url", url)
+		}
+	}
+	remotes := make(map[string]interface{})
+	for name, path := range paths {
+		if name == "default" {
+			vcs["repo"] = remoteAccess(path["url"], path["pushurl"])
+		} else {
+			remotes[name] = remoteAccess(path["url"], path["pushurl"])
+		}
+	}
+	if len(remotes) != 0 {
+		vcs["remotes"] = remotes
+	}
+	return vcs, nil
+}
@@ -0,0 +1,205 @@
+// Copyright © 2015 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codebase
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dvln/out"
+)
+
+// testClone creates a git clone (no commits needed) in the given dir with
+// the given remotes (name to URL)
+func testClone(t *testing.T, dir string, remotes map[string]string) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	testGit(t, dir, "init", "-q")
+	for name, url := range remotes {
+		testGit(t, dir, "remote", "add", name, url)
+	}
+}
+
+func TestGenerated(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is needed for this test")
+	}
+	dir, err := ioutil.TempDir("", "codebase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wkspcDir := filepath.Join(dir, "wkspc")
+	testClone(t, filepath.Join(wkspcDir, "src", "dvln"), map[string]string{
+		"origin":   "http://github.com/dvln/dvln",
+		"upstream": "http://github.com/other/dvln",
+	})
+	testGit(t, filepath.Join(wkspcDir, "src", "dvln"), "remote", "set-url", "--push", "origin", "ssh://git@github.com/dvln/dvln")
+	testClone(t, filepath.Join(wkspcDir, "src", "dvln", "lib", "viper"), map[string]string{"origin": "http://github.com/dvln/viper"})
+	testClone(t, filepath.Join(wkspcDir, "local"), nil)
+	testClone(t, filepath.Join(wkspcDir, ".dvln", "codebase", "dvln"), map[string]string{"origin": "http://github.com/dvln/codebase"})
+	defer setGlobs(map[string]interface{}{
+		"codebasePath": "",
+		"codebaseDirs": []string{},
+		"wkspcRootDir": wkspcDir,
+		"dvlnCfgDir":   dir,
+	})()
+
+	// no codebase asked for, so the workspace clones make up the codebase
+	codebaseDefn := New()
+	if err = codebaseDefn.Get(""); err != nil {
+		t.Fatalf("Get of the generated codebase failed: %s", err)
+	}
+	if codebaseDefn.Name != "generated" || len(codebaseDefn.Pkgs) != 3 {
+		t.Fatalf("Expected a generated codebase with 3 pkgs, found: %s with %+v", codebaseDefn.Name, codebaseDefn.Pkgs)
+	}
+	var names []string
+	for _, p := range codebaseDefn.Pkgs {
+		if p.Name != p.WS {
+			t.Errorf("Generated pkg %s should have a matching workspace path, found: %s", p.Name, p.WS)
+		}
+		names = append(names, p.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"local", "src/dvln", "src/dvln/lib/viper"}) {
+		t.Fatalf("Unexpected generated pkgs: %v", names)
+	}
+	dvln := codebaseDefn.Pkgs[1].VCS[0]
+	if dvln.Type != "git" || dvln.Repo["r"] != "http://github.com/dvln/dvln" || dvln.Repo["w"] != "ssh://git@github.com/dvln/dvln" {
+		t.Fatalf("Generated pkg src/dvln repo not from the origin remote: %+v", dvln)
+	}
+	if dvln.Remotes["upstream"]["rw"] != "http://github.com/other/dvln" {
+		t.Fatalf("Generated pkg src/dvln remotes not from the other remotes: %+v", dvln.Remotes)
+	}
+	if viper := codebaseDefn.Pkgs[2].VCS[0]; viper.Repo["rw"] != "http://github.com/dvln/viper" || len(viper.Remotes) != 0 {
+		t.Fatalf("Generated pkg src/dvln/lib/viper should only have a repo: %+v", viper)
+	}
+	if local := codebaseDefn.Pkgs[0].VCS[0]; len(local.Repo) != 0 || len(local.Remotes) != 0 {
+		t.Fatalf("Generated pkg local should have no repo or remotes: %+v", local)
+	}
+
+	// a missing codebase is still an error (3010), but the codebase is
+	// generated and usable
+	codebaseDefn = New()
+	if err = codebaseDefn.Get("missing"); !out.IsError(err, nil, 3010) {
+		t.Fatalf("Missing codebase should fail with error 3010, found: %v", err)
+	}
+	if codebaseDefn.Name != "generated" || len(codebaseDefn.Pkgs) != 3 {
+		t.Fatalf("Missing codebase should be generated from the workspace, found: %s with %d pkgs", codebaseDefn.Name, len(codebaseDefn.Pkgs))
+	}
+
+	// if the codebase can't be generated either both errors are noted
+	defer setGlobs(map[string]interface{}{"wkspcRootDir": filepath.Join(dir, "nope")})()
+	err = New().Get("missing")
+	if !out.IsError(err, nil, 3026) || !strings.Contains(err.Error(), "Lookup:") || !strings.Contains(err.Error(), "Generate:") {
+		t.Fatalf("Missing codebase that can't be generated should fail with error 3026, found: %v", err)
+	}
+}
+
+func TestFromWorkspace(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is needed for this test")
+	}
+	dir, err := ioutil.TempDir("", "codebase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "checkout")
+	testClone(t, filepath.Join(root, "dvln"), map[string]string{"origin": "http://github.com/dvln/dvln", "spf13": "http://github.com/spf13/viper"})
+	testClone(t, filepath.Join(root, "lib", "out"), map[string]string{"origin": "http://github.com/dvln/out"})
+	hgDir := filepath.Join(root, "lib", "hgpkg", ".hg")
+	if err = os.MkdirAll(hgDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	hgrc := "[ui]\nusername = dvln\n\n[paths]\ndefault = http://hg.dvln.org/repos/hgpkg\ndefault-push = ssh://hg@hg.dvln.org/repos/hgpkg\nmirror = http://hg.dvln.org/repos/mirror\n"
+	if err = ioutil.WriteFile(filepath.Join(hgDir, "hgrc"), []byte(hgrc), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	codebaseDefn, err := FromWorkspace(root)
+	if err != nil {
+		t.Fatalf("Codebase from workspace failed: %s", err)
+	}
+	if codebaseDefn.Name != "checkout" || len(codebaseDefn.Pkgs) != 3 {
+		t.Fatalf("Expected the checkout codebase with 3 pkgs, found: %s with %+v", codebaseDefn.Name, codebaseDefn.Pkgs)
+	}
+	expectedVars := map[string]string{"dvln": "http://github.com/dvln", "repos": "http://hg.dvln.org/repos"}
+	if !reflect.DeepEqual(codebaseDefn.Vars, expectedVars) {
+		t.Fatalf("Expected factored vars %v, found: %v", expectedVars, codebaseDefn.Vars)
+	}
+	hgPkg := codebaseDefn.Pkgs[1]
+	if hgPkg.Name != "lib/hgpkg" || hgPkg.WS != "lib/hgpkg" || hgPkg.VCS[0].Type != "hg" {
+		t.Fatalf("Expected the lib/hgpkg hg pkg, found: %+v", hgPkg)
+	}
+	hgVCS := hgPkg.VCS[0]
+	if hgVCS.Repo["r"] != "http://hg.dvln.org/repos/hgpkg" || hgVCS.Repo["w"] != "ssh://hg@hg.dvln.org/repos/hgpkg" || hgVCS.Remotes["mirror"]["rw"] != "http://hg.dvln.org/repos/mirror" {
+		t.Fatalf("Expected the hg paths as the repo and remotes (expanded), found: %+v", hgVCS)
+	}
+	if e, ok := codebaseDefn.Expansion(repoField("lib/out", 0, "rw")); !ok || e.Template != "{{.dvln}}/out" {
+		t.Fatalf("Expected lib/out repo to be expanded from a var template, found: %+v", e)
+	}
+
+	// written out the codebase uses the vars and reads back the same
+	w := new(bytes.Buffer)
+	if err = codebaseDefn.Write(w); err != nil {
+		t.Fatalf("Error writing generated codebase: %s", err)
+	}
+	if !strings.Contains(w.String(), `"{{.dvln}}/dvln"`) || strings.Contains(w.String(), `"http://github.com/dvln/dvln"`) {
+		t.Fatalf("Written codebase should use the factored vars:\n%s", w)
+	}
+	roundTrip := New()
+	if err = roundTrip.Read(bytes.NewReader(w.Bytes())); err != nil {
+		t.Fatalf("Error reading back generated codebase: %s", err)
+	}
+	if !reflect.DeepEqual(roundTrip.Pkgs, codebaseDefn.Pkgs) {
+		t.Fatalf("Generated codebase round trip failed, written:\n%s", w)
+	}
+
+	// a dir that is itself a clone is a pkg named after the dir
+	testClone(t, root, map[string]string{"origin": "http://github.com/dvln/checkout"})
+	codebaseDefn, err = FromWorkspace(root)
+	if err != nil || len(codebaseDefn.Pkgs) != 4 {
+		t.Fatalf("Expected 4 pkgs from the checkout clone, found: %+v (%v)", codebaseDefn, err)
+	}
+	if top := codebaseDefn.Pkgs[0]; top.Name != "checkout" || top.WS != "." || top.VCS[0].Repo["rw"] != "http://github.com/dvln/checkout" {
+		t.Fatalf("Expected a checkout pkg for the top clone, found: %+v", top)
+	}
+}
+
+func TestFindClones(t *testing.T) {
+	dir, err := ioutil.TempDir("", "codebase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// clones are found by their metadata dir alone, no VCS tools are run
+	for _, d := range []string{"a/.git", "a/b/.hg", "c/d/.git", ".dvln/codebase/x/.git", "e/notes"} {
+		if err = os.MkdirAll(filepath.Join(dir, filepath.FromSlash(d)), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clones, err := findClones(context.Background(), dir)
+	expected := []string{"a", "a/b", "c/d"}
+	if err != nil || !reflect.DeepEqual(clones, expected) {
+		t.Fatalf("Expected clones %v, found: %v (%v)", expected, clones, err)
+	}
+}
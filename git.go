@@ -0,0 +1,247 @@
+// Copyright © 2015 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codebase
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/dvln/out"
+	globs "github.com/dvln/viper"
+)
+
+// isGitRepo returns true if the given dir is a git clone (has a ".git"
+// dir or file) or a bare git repo (has a "HEAD" file and "objects" dir)
+func isGitRepo(dir string) bool {
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+		return true
+	}
+	head, err := os.Stat(filepath.Join(dir, "HEAD"))
+	if err != nil || head.IsDir() {
+		return false
+	}
+	objects, err := os.Stat(filepath.Join(dir, "objects"))
+	return err == nil && objects.IsDir()
+}
+
+// git runs the given git command in the given dir, returning the output
+// (stdout) of the command, any failure includes the git error output (git
+// isn't allowed to prompt for credentials, remote access must be set up),
+// the command is killed if the context is done before it completes
+func git(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if cerr := cancelErr(ctx, "git "+strings.Join(args, " ")); cerr != nil {
+			return nil, cerr
+		}
+		return nil, out.WrapErrf(err, 3012, "Git command failed: git %s (in dir: %s)\n%s", strings.Join(args, " "), dir, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// gitRevision returns the full commit id for the given revision in the
+// given git repo, HEAD is used if no revision is given
+func gitRevision(ctx context.Context, dir, rev string) (string, error) {
+	if rev == "" {
+		rev = "HEAD"
+	}
+	commit, err := git(ctx, dir, "rev-parse", "--verify", "--quiet", rev+"^{commit}")
+	if out.IsError(err, nil, 3020) {
+		return "", err
+	}
+	if err != nil {
+		return "", out.WrapErrf(err, 3013, "Codebase revision \"%s\" not found in git repo: %s", rev, dir)
+	}
+	return strings.TrimSpace(string(commit)), nil
+}
+
+// gitCodebaseFile returns the name and contents of the codebase file for
+// the named codebase at the given commit in the given git repo, each of
+// the codebaseFileNames() is tried in order, every file tried is also
+// returned (the name is "" if none were found)
+func gitCodebaseFile(ctx context.Context, dir, commit, name string) (string, []byte, []string, error) {
+	var tried []string
+	for _, fileName := range codebaseFileNames(name) {
+		tried = append(tried, dir+"@"+commit+":"+fileName)
+		if _, err := git(ctx, dir, "cat-file", "-e", commit+":"+fileName); out.IsError(err, nil, 3020) {
+			return "", nil, tried, err
+		} else if err != nil {
+			continue
+		}
+		contents, err := git(ctx, dir, "show", commit+":"+fileName)
+		if err != nil {
+			return "", nil, tried, err
+		}
+		return fileName, contents, tried, nil
+	}
+	return "", nil, tried, nil
+}
+
+// flattenURI turns a codebase URI into a single dir name for the codebase
+// cache, any runs of characters other than letters, digits, '.', '+', '_'
+// and '-' become '_' (keeping the scheme so the dir is recognizable) and a
+// short hash of the full URI is added so that different URI's never share
+// a dir (eg: "host.com/a_b" and "host.com/a/b", or the same path via
+// different schemes), eg: "git+ssh://host.com/path/to/dvln.git" is
+// "git+ssh_host.com_path_to_dvln.git-<8 hex digits>"
+func flattenURI(uri string) string {
+	sum := sha1.Sum([]byte(uri))
+	return fmt.Sprintf("%s-%x", strings.Trim(flattenRE.ReplaceAllString(uri, "_"), "_"), sum[:4])
+}
+
+var flattenRE = regexp.MustCompile(`[^A-Za-z0-9.+_-]+`)
+
+// gitCacheDir returns the codebase cache dir for the given git codebase
+// URI, ie: "<dvlnCfgDir>/codebase/<flattened-uri>", "" if there is no dvln
+// config dir (see dvlnCfgDir())
+func gitCacheDir(uri string) string {
+	cfgDir := dvlnCfgDir()
+	if cfgDir == "" {
+		return ""
+	}
+	return filepath.Join(cfgDir, "codebase", flattenURI(uri))
+}
+
+// gitCache brings the given git codebase repo into the codebase cache, it
+// is mirror cloned the first time and updated after that (unless the
+// selected revision is a commit id that is already in the cache or in
+// offline mode), the cache dir (a bare repo) is returned
+func gitCache(ctx context.Context, uri string, sel *Selector) (string, error) {
+	cacheDir := gitCacheDir(uri)
+	if cacheDir == "" {
+		return "", out.NewErrf(3017, "Unable to cache codebase \"%s\", no dvln config dir", uri)
+	}
+	if offline() {
+		if isGitRepo(cacheDir) {
+			return cacheDir, nil
+		}
+		return "", offlineErr(sel.String(), []string{uri})
+	}
+	if isGitRepo(cacheDir) {
+		if sel.Revision != "" {
+			commit, err := gitRevision(ctx, cacheDir, sel.Revision)
+			if err == nil && strings.HasPrefix(commit, strings.ToLower(sel.Revision)) {
+				return cacheDir, nil
+			}
+		}
+		if _, err := git(ctx, cacheDir, "remote", "update", "--prune"); err != nil {
+			return "", err
+		}
+		return cacheDir, nil
+	}
+	// clone alongside the cache dir and move it into place when complete so
+	// an interrupted clone never leaves a partial repo in the cache
+	if err := os.MkdirAll(filepath.Dir(cacheDir), 0755); err != nil {
+		return "", out.WrapErrf(err, 3017, "Unable to create codebase cache dir for \"%s\"", uri)
+	}
+	tmpDir, err := ioutil.TempDir(filepath.Dir(cacheDir), ".clone")
+	if err != nil {
+		return "", out.WrapErrf(err, 3017, "Unable to create codebase cache dir for \"%s\"", uri)
+	}
+	defer os.RemoveAll(tmpDir)
+	if _, err = git(ctx, "", "clone", "--quiet", "--mirror", gitURL(uri), tmpDir); err != nil {
+		return "", err
+	}
+	if err = os.Rename(tmpDir, cacheDir); err != nil {
+		return "", out.WrapErrf(err, 3017, "Unable to move codebase clone into cache dir \"%s\"", cacheDir)
+	}
+	return cacheDir, nil
+}
+
+// wkspcCodebaseDir returns the dir the codebase pkg clone for the named
+// codebase goes in within the workspace, ie: "<wkspcRootDir>/.dvln/codebase/
+// <name>", "" is returned if not in a workspace
+func wkspcCodebaseDir(name string) string {
+	wkspcDir := globs.GetString("wkspcRootDir")
+	if wkspcDir == "" {
+		return ""
+	}
+	return filepath.Join(wkspcDir, ".dvln", "codebase", filepath.FromSlash(name))
+}
+
+// codebaseRepo returns the URI and the local git repo of the codebase pkg
+// for a codebase the given fetcher fetched from the given URI, "" if the
+// codebase isn't in a git repo.  For fetchers with a cache (see Cacher)
+// the repo is the cached repo (eg: the git codebase cache dir, see
+// gitCache()), for local codebases the repo is the local git clone or bare
+// repo itself.  A local repo that is a git codebase cache dir (as found in
+// offline mode) has the URI of the remote it mirrors.
+func codebaseRepo(ctx context.Context, f Fetcher, uri string) (string, string, error) {
+	if c, ok := f.(Cacher); ok {
+		if cached := c.Cached(uri); cached != "" && isGitRepo(cached) {
+			return uri, cached, nil
+		}
+	}
+	location, ok := localPath(uri)
+	if !ok || !isGitRepo(location) {
+		return "", "", nil
+	}
+	if cfgDir := dvlnCfgDir(); cfgDir != "" && filepath.Dir(filepath.Clean(location)) == filepath.Join(cfgDir, "codebase") {
+		origin, err := git(ctx, location, "config", "--get", "remote.origin.url")
+		if out.IsError(err, nil, 3020) {
+			return "", "", err
+		}
+		if err == nil {
+			return strings.TrimSpace(string(origin)), location, nil
+		}
+	}
+	return uri, location, nil
+}
+
+// wkspcClone brings the codebase pkg for the given git codebase URI into
+// the workspace (if in one) from the given local repo (the codebase cache
+// dir or a local codebase repo, see codebaseRepo()), no re-fetching is
+// done: the clone is a local clone of the repo (hard linking the git
+// objects where possible) with origin then set to the codebase URI and
+// checked out at the given commit (if a revision was selected), for an
+// existing workspace clone the new repo commits are fetched into it and
+// its working tree is left alone
+func wkspcClone(ctx context.Context, uri, repoDir string, sel *Selector, commit string) error {
+	cloneDir := wkspcCodebaseDir(sel.Name)
+	if cloneDir == "" || filepath.Clean(repoDir) == cloneDir {
+		return nil
+	}
+	if isGitRepo(cloneDir) {
+		_, err := git(ctx, cloneDir, "fetch", "--quiet", "--tags", repoDir, "+refs/heads/*:refs/remotes/origin/*")
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(cloneDir), 0755); err != nil {
+		return out.WrapErrf(err, 3018, "Unable to create workspace codebase dir for \"%s\"", uri)
+	}
+	if _, err := git(ctx, "", "clone", "--quiet", repoDir, cloneDir); err != nil {
+		return err
+	}
+	if _, err := git(ctx, cloneDir, "remote", "set-url", "origin", gitURL(uri)); err != nil {
+		return err
+	}
+	if sel.Revision != "" {
+		if _, err := git(ctx, cloneDir, "checkout", "--quiet", commit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
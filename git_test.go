@@ -0,0 +1,296 @@
+// Copyright © 2015 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codebase
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dvln/out"
+)
+
+// testGit runs a git command for a test in the given dir, returning the
+// (trimmed) output, the test fails if the command does
+func testGit(t *testing.T, dir string, args ...string) string {
+	args = append([]string{"-c", "user.name=dvln", "-c", "user.email=dvln@dvln.org"}, args...)
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s failed: %s\n%s", strings.Join(args, " "), err, output)
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// testCodebaseRepo creates a git repo in the given dir with 2 commits of
+// the given codebase file, the first with the codebase name "old" and
+// the 2nd with the name "dvln", the commit ids are returned (old, new)
+func testCodebaseRepo(t *testing.T, dir, fileName string) (string, string) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is needed for this test")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	testGit(t, dir, "init", "-q")
+	old := strings.Replace(string(codebaseExample), `"name" : "dvln"`, `"name" : "old"`, 1)
+	if err := ioutil.WriteFile(filepath.Join(dir, fileName), []byte(old), 0644); err != nil {
+		t.Fatal(err)
+	}
+	testGit(t, dir, "add", fileName)
+	testGit(t, dir, "commit", "-q", "-m", "old codebase")
+	testGit(t, dir, "tag", "v1")
+	if err := ioutil.WriteFile(filepath.Join(dir, fileName), codebaseExample, 0644); err != nil {
+		t.Fatal(err)
+	}
+	testGit(t, dir, "commit", "-q", "-a", "-m", "new codebase")
+	return testGit(t, dir, "rev-parse", "v1"), testGit(t, dir, "rev-parse", "HEAD")
+}
+
+func TestGetRevision(t *testing.T) {
+	dir, err := ioutil.TempDir("", "codebase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldCommit, newCommit := testCodebaseRepo(t, filepath.Join(dir, "clones", "dvln"), "dvln.codebase")
+	defer setGlobs(map[string]interface{}{
+		"codebasePath": filepath.Join(dir, "clones"),
+		"codebaseDirs": []string{},
+		"wkspcRootDir": "",
+		"dvlnCfgDir":   dir,
+	})()
+
+	tests := []struct {
+		sel    string
+		name   string
+		pkgRev string
+	}{
+		{"dvln", "dvln", newCommit},
+		{"dvln@v1", "old", oldCommit},
+		{"dvln@" + oldCommit[:10], "old", oldCommit},
+	}
+	for _, test := range tests {
+		codebaseDefn := New()
+		if err = codebaseDefn.Get(test.sel); err != nil {
+			t.Fatalf("Get of %s failed: %s", test.sel, err)
+		}
+		if codebaseDefn.Name != test.name || string(codebaseDefn.PkgRev) != test.pkgRev {
+			t.Errorf("Get of %s should have name %s at rev %s, found: %s at %s", test.sel, test.name, test.pkgRev, codebaseDefn.Name, codebaseDefn.PkgRev)
+		}
+	}
+	if err = New().Get("dvln@nope"); !out.IsError(err, nil, 3013) {
+		t.Fatalf("Get of a missing revision should fail with error 3013, found: %v", err)
+	}
+	// devlines aren't supported yet, they're not just ignored
+	for _, sel := range []string{"dvln:release", "dvln@v1:main"} {
+		if err = New().Get(sel); !out.IsError(err, nil, 3024) || !strings.Contains(err.Error(), "devline") {
+			t.Errorf("Get of %s should fail as devlines aren't supported (3024), found: %v", sel, err)
+		}
+	}
+
+	// a bare repo is read at HEAD, plain dirs can't give a revision
+	bareDir := filepath.Join(dir, "bare", "dvln.git")
+	testGit(t, dir, "clone", "-q", "--bare", filepath.Join(dir, "clones", "dvln"), bareDir)
+	codebaseDefn := New()
+	if err = codebaseDefn.Get(bareDir); err != nil {
+		t.Fatalf("Get of a bare repo failed: %s", err)
+	}
+	if codebaseDefn.Name != "dvln" || string(codebaseDefn.PkgRev) != newCommit {
+		t.Fatalf("Get of a bare repo should be at HEAD, found: %s at %s", codebaseDefn.Name, codebaseDefn.PkgRev)
+	}
+	if err = os.MkdirAll(filepath.Join(dir, "clones", "plain"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "clones", "plain", "plain.json"), codebaseExample, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = New().Get("plain"); err != nil {
+		t.Fatalf("Get of a plain codebase dir failed: %s", err)
+	}
+	if err = New().Get("plain@v1"); !out.IsError(err, nil, 3014) {
+		t.Fatalf("Get of a plain codebase dir revision should fail with error 3014, found: %v", err)
+	}
+}
+
+func TestFlattenURI(t *testing.T) {
+	tests := map[string]string{
+		"git+ssh://host.com/path/to/dvln.git":    "git+ssh_host.com_path_to_dvln.git-",
+		"git+https://github.com/dvln/dvln":       "git+https_github.com_dvln_dvln-",
+		"git://git@host.com:2222/dvln/dvln.git/": "git_git_host.com_2222_dvln_dvln.git-",
+		"git+file:///some/local/dir/dvln":        "git+file_some_local_dir_dvln-",
+	}
+	for uri, flat := range tests {
+		found := flattenURI(uri)
+		if !strings.HasPrefix(found, flat) || len(found) != len(flat)+8 {
+			t.Errorf("Flattened %s should be %s<hash>, found: %s", uri, flat, found)
+		}
+	}
+	// URI's that flatten alike still get their own dirs
+	for _, uris := range [][2]string{
+		{"git+ssh://host/a/b", "git+https://host/a/b"},
+		{"git+ssh://host/a_b", "git+ssh://host/a/b"},
+	} {
+		if flattenURI(uris[0]) == flattenURI(uris[1]) {
+			t.Errorf("Flattened %s and %s should differ, both are: %s", uris[0], uris[1], flattenURI(uris[0]))
+		}
+	}
+}
+
+func TestGitCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "codebase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cloneDir := filepath.Join(dir, "clones", "dvln")
+	oldCommit, newCommit := testCodebaseRepo(t, cloneDir, "dvln.codebase")
+	testGit(t, dir, "clone", "-q", "--bare", cloneDir, filepath.Join(dir, "remote", "dvln.git"))
+	remote := "git+file://" + filepath.ToSlash(filepath.Join(dir, "remote"))
+	cfgDir := filepath.Join(dir, "cfg")
+	defer setGlobs(map[string]interface{}{
+		"codebasePath": remote,
+		"codebaseDirs": []string{},
+		"wkspcRootDir": "",
+		"dvlnCfgDir":   cfgDir,
+	})()
+
+	// the first Get clones the repo into the cache
+	codebaseDefn := New()
+	if err = codebaseDefn.Get("dvln"); err != nil || string(codebaseDefn.PkgRev) != newCommit {
+		t.Fatalf("Get of the remote codebase failed: %v (rev %s)", err, codebaseDefn.PkgRev)
+	}
+	cacheDir := filepath.Join(cfgDir, "codebase", flattenURI(remote+"/dvln"))
+	if !isGitRepo(cacheDir) {
+		t.Fatalf("Expected the codebase repo to be cached in %s", cacheDir)
+	}
+
+	// later ones update the cache, picking up new commits
+	if err = ioutil.WriteFile(filepath.Join(cloneDir, "dvln.codebase"), codebaseExample[:len(codebaseExample)-1], 0644); err != nil {
+		t.Fatal(err)
+	}
+	testGit(t, cloneDir, "commit", "-q", "-a", "-m", "newer codebase")
+	testGit(t, cloneDir, "push", "-q", filepath.Join(dir, "remote", "dvln.git"), "HEAD:master", "HEAD:main")
+	newerCommit := testGit(t, cloneDir, "rev-parse", "HEAD")
+	codebaseDefn = New()
+	if err = codebaseDefn.Get("dvln"); err != nil || string(codebaseDefn.PkgRev) != newerCommit {
+		t.Fatalf("Get of the updated remote codebase should be at %s, found: %s (%v)", newerCommit, codebaseDefn.PkgRev, err)
+	}
+
+	// commit ids already in the cache are read without updating it
+	if err = os.RemoveAll(filepath.Join(dir, "remote")); err != nil {
+		t.Fatal(err)
+	}
+	cacheSel := &Selector{Location: "dvln", Name: "dvln", Revision: oldCommit[:12]}
+	if _, _, rev, err := (gitFetcher{}).Fetch(context.Background(), remote+"/dvln", cacheSel); err != nil || rev != oldCommit {
+		t.Fatalf("Fetch of a cached commit should not need the remote, found: %s (%v)", rev, err)
+	}
+	cacheSel.Revision = "v1"
+	if _, _, _, err = (gitFetcher{}).Fetch(context.Background(), remote+"/dvln", cacheSel); !out.IsError(err, nil, 3012) {
+		t.Fatalf("Fetch of a tag should update the (missing) remote and fail with error 3012, found: %v", err)
+	}
+}
+
+func TestWkspcClone(t *testing.T) {
+	dir, err := ioutil.TempDir("", "codebase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cloneDir := filepath.Join(dir, "clones", "dvln")
+	oldCommit, _ := testCodebaseRepo(t, cloneDir, "dvln.codebase")
+	testGit(t, dir, "clone", "-q", "--bare", cloneDir, filepath.Join(dir, "remote", "dvln.git"))
+	remote := "git+file://" + filepath.ToSlash(filepath.Join(dir, "remote"))
+	wkspcDir := filepath.Join(dir, "wkspc")
+	defer setGlobs(map[string]interface{}{
+		"codebasePath": remote,
+		"codebaseDirs": []string{},
+		"wkspcRootDir": wkspcDir,
+		"dvlnCfgDir":   filepath.Join(dir, "cfg"),
+	})()
+
+	// the codebase pkg is cloned into the workspace at the selected rev
+	if err = New().Get("dvln@v1"); err != nil {
+		t.Fatalf("Get of the remote codebase into the workspace failed: %s", err)
+	}
+	wkspcClone := filepath.Join(wkspcDir, ".dvln", "codebase", "dvln")
+	if head := testGit(t, wkspcClone, "rev-parse", "HEAD"); head != oldCommit {
+		t.Fatalf("Workspace codebase clone should be at %s, found: %s", oldCommit, head)
+	}
+	if origin := testGit(t, wkspcClone, "config", "remote.origin.url"); origin != gitURL(remote+"/dvln") {
+		t.Fatalf("Workspace codebase clone origin should be the codebase URL, found: %s", origin)
+	}
+
+	// the git objects are shared with the cache, not re-fetched
+	cachePacks, err := filepath.Glob(filepath.Join(gitCacheDir(remote+"/dvln"), "objects", "pack", "*.pack"))
+	if err != nil || len(cachePacks) == 0 {
+		t.Fatalf("Expected packed objects in the codebase cache: %v", err)
+	}
+	cacheFi, err := os.Stat(cachePacks[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	cloneFi, err := os.Stat(filepath.Join(wkspcClone, ".git", "objects", "pack", filepath.Base(cachePacks[0])))
+	if err != nil || !os.SameFile(cacheFi, cloneFi) {
+		t.Fatalf("Workspace codebase clone objects should be hard linked to the cache: %v", err)
+	}
+
+	// an existing workspace clone gets new commits but is left checked out
+	if err = ioutil.WriteFile(filepath.Join(cloneDir, "dvln.codebase"), codebaseExample[:len(codebaseExample)-1], 0644); err != nil {
+		t.Fatal(err)
+	}
+	testGit(t, cloneDir, "commit", "-q", "-a", "-m", "newer codebase")
+	testGit(t, cloneDir, "push", "-q", filepath.Join(dir, "remote", "dvln.git"), "HEAD:master", "HEAD:main")
+	newerCommit := testGit(t, cloneDir, "rev-parse", "HEAD")
+	if err = New().Get("dvln"); err != nil {
+		t.Fatalf("Get of the updated remote codebase failed: %s", err)
+	}
+	if _, err = gitRevision(context.Background(), wkspcClone, newerCommit); err != nil {
+		t.Fatalf("Workspace codebase clone should have the new commit: %s", err)
+	}
+	if head := testGit(t, wkspcClone, "rev-parse", "HEAD"); head != oldCommit {
+		t.Fatalf("Workspace codebase clone should still be at %s, found: %s", oldCommit, head)
+	}
+
+	// offline the cached repo is cloned, origin is still the codebase URL
+	os.RemoveAll(wkspcClone)
+	restore := setGlobs(map[string]interface{}{"offline": true})
+	err = New().Get("dvln")
+	restore()
+	if err != nil {
+		t.Fatalf("Offline get of the cached codebase failed: %s", err)
+	}
+	if origin := testGit(t, wkspcClone, "config", "remote.origin.url"); origin != gitURL(remote+"/dvln") {
+		t.Fatalf("Offline workspace codebase clone origin should be the codebase URL, found: %s", origin)
+	}
+
+	// local codebase repos on the search path are cloned too
+	os.RemoveAll(wkspcClone)
+	bareDir := filepath.Join(dir, "remote", "dvln.git")
+	defer setGlobs(map[string]interface{}{"codebasePath": filepath.ToSlash(filepath.Join(dir, "remote"))})()
+	if err = New().Get("dvln@v1"); err != nil {
+		t.Fatalf("Get of the local codebase repo into the workspace failed: %s", err)
+	}
+	if head := testGit(t, wkspcClone, "rev-parse", "HEAD"); head != oldCommit {
+		t.Fatalf("Workspace clone of the local codebase repo should be at %s, found: %s", oldCommit, head)
+	}
+	if origin := testGit(t, wkspcClone, "config", "remote.origin.url"); origin != bareDir {
+		t.Fatalf("Workspace clone of the local codebase repo origin should be %s, found: %s", bareDir, origin)
+	}
+}
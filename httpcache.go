@@ -0,0 +1,184 @@
+// Copyright © 2015 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codebase
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dvln/out"
+	globs "github.com/dvln/viper"
+)
+
+// defaultCacheTTL is used if the "codebaseCacheTTL" setting isn't set
+const defaultCacheTTL = 5 * time.Minute
+
+// codebaseCacheTTL returns how long a cached http codebase file is used
+// without revalidating it with the server, this is the "codebaseCacheTTL"
+// setting (eg: "30s", "10m", "1h", "0" to always revalidate), it defaults
+// to 5 minutes if not set (or not valid)
+func codebaseCacheTTL() time.Duration {
+	setting := globs.GetString("codebaseCacheTTL")
+	if setting == "" {
+		return defaultCacheTTL
+	}
+	ttl, err := time.ParseDuration(setting)
+	if err != nil || ttl < 0 {
+		out.Debugf("Invalid codebaseCacheTTL setting \"%s\", using %s\n", setting, defaultCacheTTL)
+		return defaultCacheTTL
+	}
+	return ttl
+}
+
+// httpCache is a cached http codebase file, the validators (ETag and the
+// Last-Modified time) from the server are kept so the cached file can be
+// cheaply revalidated once it is older than the codebaseCacheTTL()
+type httpCache struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+	Fetched      time.Time `json:"fetched"`
+	contents     []byte
+}
+
+// httpCacheDir returns the codebase cache dir for the given http codebase
+// URI, ie: "<dvlnCfgDir>/codebase/<flattened-uri>.http", "" if there is no
+// dvln config dir (see dvlnCfgDir()) in which case nothing is cached
+func httpCacheDir(uri string) string {
+	cfgDir := dvlnCfgDir()
+	if cfgDir == "" {
+		return ""
+	}
+	return filepath.Join(cfgDir, "codebase", flattenURI(uri)+".http")
+}
+
+// loadHTTPCache returns the cached codebase file for the given http
+// codebase URI, nil is returned if there isn't one (or it can't be read)
+func loadHTTPCache(uri string) *httpCache {
+	cacheDir := httpCacheDir(uri)
+	if cacheDir == "" {
+		return nil
+	}
+	meta, err := ioutil.ReadFile(filepath.Join(cacheDir, "cache.json"))
+	if err != nil {
+		return nil
+	}
+	cached := &httpCache{}
+	if err = json.Unmarshal(meta, cached); err != nil {
+		out.Debugf("Ignoring bad codebase cache \"%s\": %s\n", cacheDir, err)
+		return nil
+	}
+	if cached.contents, err = ioutil.ReadFile(filepath.Join(cacheDir, "contents")); err != nil {
+		return nil
+	}
+	return cached
+}
+
+// fresh returns true if the cached file can be used as is
+func (cached *httpCache) fresh() bool {
+	return time.Since(cached.Fetched) < codebaseCacheTTL()
+}
+
+// save writes the cached file to the cache dir for the given http codebase
+// URI (the contents go first so a partial write is never used), problems
+// saving are noted but otherwise ignored as the cache is just an aid
+func (cached *httpCache) save(uri string) {
+	cacheDir := httpCacheDir(uri)
+	if cacheDir == "" {
+		return
+	}
+	meta, err := json.MarshalIndent(cached, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(cacheDir, 0755)
+	}
+	if err == nil {
+		err = os.Remove(filepath.Join(cacheDir, "cache.json"))
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(cacheDir, "contents"), cached.contents, 0644)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(cacheDir, "cache.json"), meta, 0644)
+	}
+	if err != nil {
+		out.Debugf("Unable to cache codebase \"%s\" in \"%s\": %s\n", cached.URL, cacheDir, err)
+	}
+}
+
+// httpGet gets the given codebase file URL, if the cached file is from the
+// URL it is revalidated (a conditional request is made using the cached
+// validators), the response status is returned along with the file, for a
+// 304 (not modified) response this is the cached file (refreshed), server
+// errors and network problems are returned as errors (as is the context
+// being done, error 3020, in which case no stale cached file should be used)
+func httpGet(ctx context.Context, fileURL string, cached *httpCache) (*httpCache, int, error) {
+	req, err := http.NewRequest("GET", fileURL, nil)
+	if err != nil {
+		return nil, 0, out.WrapErrf(err, 3015, "Codebase URL \"%s\" fetch failed", fileURL)
+	}
+	revalidate := cached != nil && cached.URL == fileURL
+	if revalidate {
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if cerr := cancelErr(ctx, "fetch of codebase URL "+fileURL); cerr != nil {
+		if err == nil {
+			resp.Body.Close()
+		}
+		return nil, 0, cerr
+	}
+	if err != nil {
+		return nil, 0, out.WrapErrf(err, 3015, "Codebase URL \"%s\" fetch failed", fileURL)
+	}
+	defer resp.Body.Close()
+	contents, err := ioutil.ReadAll(resp.Body)
+	if cerr := cancelErr(ctx, "fetch of codebase URL "+fileURL); cerr != nil {
+		return nil, 0, cerr
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotModified && revalidate:
+		refreshed := *cached
+		refreshed.Fetched = time.Now()
+		if etag := resp.Header.Get("ETag"); etag != "" {
+			refreshed.ETag = etag
+		}
+		return &refreshed, resp.StatusCode, nil
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, resp.StatusCode, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, resp.StatusCode, out.NewErrf(3015, "Codebase URL \"%s\" fetch failed: %s", fileURL, resp.Status)
+	case err != nil:
+		return nil, resp.StatusCode, out.WrapErrf(err, 3015, "Codebase URL \"%s\" fetch failed", fileURL)
+	}
+	return &httpCache{
+		URL:          fileURL,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Fetched:      time.Now(),
+		contents:     contents,
+	}, resp.StatusCode, nil
+}
@@ -0,0 +1,112 @@
+// Copyright © 2015 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codebase
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dvln/out"
+	globs "github.com/dvln/viper"
+)
+
+func TestCodebaseCacheTTL(t *testing.T) {
+	tests := map[string]time.Duration{
+		"":     defaultCacheTTL,
+		"1h":   time.Hour,
+		"0":    0,
+		"-1m":  defaultCacheTTL,
+		"nope": defaultCacheTTL,
+	}
+	for setting, ttl := range tests {
+		restore := setGlobs(map[string]interface{}{"codebaseCacheTTL": setting})
+		if found := codebaseCacheTTL(); found != ttl {
+			t.Errorf("Cache TTL for %q should be %s, found: %s", setting, ttl, found)
+		}
+		restore()
+	}
+}
+
+func TestHTTPCache(t *testing.T) {
+	var gets, notModified int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/codebases/dvln.json" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method == "GET" {
+			atomic.AddInt32(&gets, 1)
+		}
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt32(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write(codebaseExample)
+	}))
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "codebase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer setGlobs(map[string]interface{}{
+		"codebasePath":     srv.URL + "/codebases",
+		"codebaseDirs":     []string{},
+		"wkspcRootDir":     "",
+		"dvlnCfgDir":       dir,
+		"codebaseCacheTTL": "1h",
+	})()
+
+	// within the TTL the codebase file is only downloaded once
+	for i := 0; i < 3; i++ {
+		codebaseDefn := New()
+		if err = codebaseDefn.Get("dvln"); err != nil || codebaseDefn.Name != "dvln" {
+			t.Fatalf("Get of the http codebase failed: %v", err)
+		}
+	}
+	if atomic.LoadInt32(&gets) != 1 {
+		t.Fatalf("Expected 1 download of the codebase within the cache TTL, found: %d", gets)
+	}
+	cached := loadHTTPCache(srv.URL + "/codebases/dvln")
+	if cached == nil || cached.URL != srv.URL+"/codebases/dvln.json" || cached.ETag != `"v1"` {
+		t.Fatalf("Expected the codebase to be cached with its ETag, found: %+v", cached)
+	}
+
+	// once stale the cached file is revalidated rather than downloaded
+	globs.Set("codebaseCacheTTL", "0")
+	codebaseDefn := New()
+	if err = codebaseDefn.Get("dvln"); err != nil || codebaseDefn.Name != "dvln" {
+		t.Fatalf("Get of the stale http codebase failed: %v", err)
+	}
+	if atomic.LoadInt32(&gets) != 2 || atomic.LoadInt32(&notModified) != 1 {
+		t.Fatalf("Expected the stale codebase to be revalidated (304), found: %d gets, %d not modified", gets, notModified)
+	}
+
+	// and it is used, no matter how stale, if the server is unreachable
+	srv.Close()
+	codebaseDefn = New()
+	if err = codebaseDefn.Get("dvln"); err != nil || codebaseDefn.Name != "dvln" {
+		t.Fatalf("Get of the cached codebase with the server down failed: %v", err)
+	}
+	if _, _, err = New().Exists(srv.URL + "/codebases/other"); !out.IsError(err, nil, 3010) {
+		t.Fatalf("Uncached codebases should not be found with the server down, found: %v", err)
+	}
+}
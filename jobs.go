@@ -0,0 +1,121 @@
+// Copyright © 2015 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codebase
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dvln/out"
+	"github.com/dvln/pkg"
+)
+
+// Jobs returns how many per-pkg operations (clones, fetches, status and
+// existence checks) are run at once for the codebase, this is the codebase
+// "jobs" attr (eg: "4") and defaults to the number of CPU's if not set
+// (or not a positive number)
+func (cb *Defn) Jobs() int {
+	setting, ok := cb.Attrs["jobs"]
+	if !ok || setting == "" {
+		return runtime.NumCPU()
+	}
+	jobs, err := strconv.Atoi(setting)
+	if err != nil || jobs < 1 {
+		out.Debugf("Invalid codebase jobs attr \"%s\", using %d\n", setting, runtime.NumCPU())
+		return runtime.NumCPU()
+	}
+	return jobs
+}
+
+// PkgOp is an operation on a single pkg of a codebase, see EachPkg()
+type PkgOp func(ctx context.Context, p *pkg.Defn) error
+
+// PkgErrors are the errors from running an operation over the pkgs of a
+// codebase (see EachPkg()), keyed by pkg name
+type PkgErrors map[string]error
+
+// Error returns the pkg errors, one pkg per line (sorted by pkg name)
+func (errs PkgErrors) Error() string {
+	names := make([]string, 0, len(errs))
+	for name := range errs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf("Pkg \"%s\": %s", name, errs[name]))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// EachPkg runs the given operation on every pkg of the codebase, with up
+// to the given number of pkgs in progress at once (0 for the codebase
+// default, see Jobs()), see runPkgs()
+func (cb *Defn) EachPkg(ctx context.Context, jobs int, op PkgOp) error {
+	pkgs := make([]*pkg.Defn, len(cb.Pkgs))
+	for i := range cb.Pkgs {
+		pkgs[i] = &cb.Pkgs[i]
+	}
+	return cb.runPkgs(ctx, jobs, pkgs, op)
+}
+
+// runPkgs runs the given operation on the given pkgs using a pool of
+// workers, up to the given number of pkgs are in progress at once (0 for
+// the codebase default, see Jobs()).  The operation is run on every pkg,
+// a failing pkg doesn't stop the others, and the errors are returned as
+// PkgErrors (nil if all went well).  Once the context is done pkgs not yet
+// started fail with error 3020 (so the operation should also watch it).
+func (cb *Defn) runPkgs(ctx context.Context, jobs int, pkgs []*pkg.Defn, op PkgOp) error {
+	if jobs <= 0 {
+		jobs = cb.Jobs()
+	}
+	if jobs > len(pkgs) {
+		jobs = len(pkgs)
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	errs := make(PkgErrors)
+	work := make(chan *pkg.Defn)
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range work {
+				err := cancelErr(ctx, "operation on pkg "+p.Name)
+				if err == nil {
+					err = op(ctx, p)
+				}
+				if err != nil {
+					mu.Lock()
+					errs[p.Name] = err
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, p := range pkgs {
+		work <- p
+	}
+	close(work)
+	wg.Wait()
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
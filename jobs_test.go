@@ -0,0 +1,115 @@
+// Copyright © 2015 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codebase
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dvln/out"
+	"github.com/dvln/pkg"
+)
+
+func TestJobs(t *testing.T) {
+	tests := map[string]int{
+		"4":    4,
+		"1":    1,
+		"":     runtime.NumCPU(),
+		"0":    runtime.NumCPU(),
+		"many": runtime.NumCPU(),
+	}
+	for setting, jobs := range tests {
+		cb := New()
+		cb.Attrs = map[string]string{"jobs": setting}
+		if found := cb.Jobs(); found != jobs {
+			t.Errorf("Jobs for attr %q should be %d, found: %d", setting, jobs, found)
+		}
+	}
+	if found := New().Jobs(); found != runtime.NumCPU() {
+		t.Errorf("Jobs with no attr should be %d, found: %d", runtime.NumCPU(), found)
+	}
+}
+
+// testPkgs returns a codebase with the given number of pkgs and jobs attr
+func testPkgs(count int, jobs string) *Defn {
+	cb := New()
+	cb.Attrs = map[string]string{"jobs": jobs}
+	cb.Pkgs = make([]pkg.Defn, count)
+	for i := range cb.Pkgs {
+		cb.Pkgs[i].Name = fmt.Sprintf("pkg%03d", i)
+	}
+	return cb
+}
+
+func TestEachPkg(t *testing.T) {
+	cb := testPkgs(300, "4")
+	var running, maxRunning, done int32
+	op := func(ctx context.Context, p *pkg.Defn) error {
+		now := atomic.AddInt32(&running, 1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if now <= max || atomic.CompareAndSwapInt32(&maxRunning, max, now) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		atomic.AddInt32(&done, 1)
+		if strings.HasSuffix(p.Name, "7") {
+			return out.NewErrf(3022, "Pkg %s failed", p.Name)
+		}
+		return nil
+	}
+
+	// the codebase jobs attr bounds the pkgs in progress at once
+	err := cb.EachPkg(context.Background(), 0, op)
+	if done != 300 || maxRunning < 2 || maxRunning > 4 {
+		t.Fatalf("Expected all 300 pkgs done, 2-4 at a time, found: %d done, %d at once", done, maxRunning)
+	}
+	errs, ok := err.(PkgErrors)
+	if !ok || len(errs) != 30 || !out.IsError(errs["pkg017"], nil, 3022) {
+		t.Fatalf("Expected the 30 failing pkgs to have errors, found: %v", err)
+	}
+	if !strings.HasPrefix(errs.Error(), `Pkg "pkg007": `) {
+		t.Fatalf("Expected pkg errors sorted by pkg name, found:\n%s", errs)
+	}
+
+	// callers can override it
+	done, maxRunning = 0, 0
+	cb.EachPkg(context.Background(), 1, op)
+	if done != 300 || maxRunning != 1 {
+		t.Fatalf("Expected all 300 pkgs done, 1 at a time, found: %d done, %d at once", done, maxRunning)
+	}
+	if err = testPkgs(10, "2").EachPkg(context.Background(), 0, func(context.Context, *pkg.Defn) error { return nil }); err != nil {
+		t.Fatalf("Expected no error when all pkgs succeed, found: %v", err)
+	}
+
+	// once cancelled pkgs not yet started fail
+	ctx, cancel := context.WithCancel(context.Background())
+	err = testPkgs(100, "2").EachPkg(ctx, 0, func(ctx context.Context, p *pkg.Defn) error {
+		if p.Name == "pkg010" {
+			cancel()
+		}
+		return nil
+	})
+	errs, ok = err.(PkgErrors)
+	if !ok || len(errs) < 80 || !out.IsError(errs["pkg099"], nil, 3020) {
+		t.Fatalf("Expected pkgs after the cancel to fail (3020), found %d errors: %v", len(errs), errs["pkg099"])
+	}
+}
@@ -0,0 +1,638 @@
+// Copyright © 2015 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codebase
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/dvln/out"
+)
+
+// Doc is a codebase definition along with the file contents it was read
+// from.  Codebase files are hand maintained and reviewed in diffs so, when
+// a Doc is written, only the JSON nodes that changed in the Defn since it
+// was read are re-written, all other key order, comments and formatting
+// is left exactly as it was in the original file.  Quick overview:
+//   Defn: the codebase definition, adjust as needed before Write()
+//   src: the codebase file contents as last read or written
+//   base: the JSON encoding of the Defn as last read or written, this is
+//         what the current Defn is compared against to find the changes
+type Doc struct {
+	Defn *Defn
+	src  []byte
+	base []byte
+}
+
+// ReadDoc will, given an io.Reader, read in the codebase contents much
+// like Defn.Read() but will hang onto the original file contents so
+// the returned Doc can be written back out with minimal changes
+func ReadDoc(r io.Reader) (*Doc, error) {
+	src, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, out.WrapErr(err, "Failed to read codebase JSON", 3001)
+	}
+	cb := New()
+	if err = cb.Read(bytes.NewReader(src)); err != nil {
+		return nil, err
+	}
+	base, err := cb.encodeJSON()
+	if err != nil {
+		return nil, err
+	}
+	return &Doc{Defn: cb, src: src, base: base}, nil
+}
+
+// Write will, given an io.Writer, write the codebase definition out by
+// patching the original file contents with whatever changed in the Defn
+// since it was read (or last written).  New object members and array
+// entries are added at the end of their enclosing object or array in
+// the surrounding indentation style.  A Doc not created via ReadDoc is
+// written just as Defn.Write() would write it.
+func (d *Doc) Write(w io.Writer) error {
+	nu, err := d.Defn.encodeJSON()
+	if err != nil {
+		return err
+	}
+	patched := nu
+	if d.src != nil {
+		patched, err = patchJSON(d.src, d.base, nu)
+		if err != nil {
+			return err
+		}
+	}
+	if _, err = w.Write(patched); err != nil {
+		return out.WrapErr(err, "Failed to write codebase JSON", 3007)
+	}
+	d.src = patched
+	d.base = nu
+	return nil
+}
+
+// jsonNode is a parsed JSON value along with the byte offsets for where
+// it lives in the document it was parsed from
+type jsonNode struct {
+	kind  byte // '{' for objects, '[' for arrays, 0 for any other value
+	start int  // offset of the first byte of the value
+	end   int  // offset just past the last byte of the value
+	keys  []string
+	keyAt []int // offsets of the object member keys (quote included)
+	kids  []*jsonNode
+}
+
+// member returns the index of the object member with the given key, an
+// exact match is preferred but, as the codebase decoder does, a case
+// insensitive match is used otherwise, -1 is returned if there is none
+func (n *jsonNode) member(key string) int {
+	for i, k := range n.keys {
+		if k == key {
+			return i
+		}
+	}
+	for i, k := range n.keys {
+		if strings.EqualFold(k, key) {
+			return i
+		}
+	}
+	return -1
+}
+
+// jsonParser is a minimal JSON scanner that records where every value
+// lives, it treats "//" and "/* */" comments as whitespace
+type jsonParser struct {
+	data []byte
+	pos  int
+}
+
+// parseJSON parses the given JSON document into a tree of jsonNodes
+func parseJSON(data []byte) (*jsonNode, error) {
+	p := &jsonParser{data: data}
+	n, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	p.skip()
+	if p.pos != len(p.data) {
+		return nil, p.errorf("unexpected trailing data")
+	}
+	return n, nil
+}
+
+func (p *jsonParser) errorf(msg string) error {
+	return out.NewErrf(3008, "Failed to parse codebase JSON document: %s (Bad Char Offset: %d)", msg, p.pos)
+}
+
+// skip moves past any whitespace and comments
+func (p *jsonParser) skip() {
+	for p.pos < len(p.data) {
+		switch c := p.data[p.pos]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			p.pos++
+		case bytes.HasPrefix(p.data[p.pos:], []byte("//")):
+			if i := bytes.IndexByte(p.data[p.pos:], '\n'); i >= 0 {
+				p.pos += i
+			} else {
+				p.pos = len(p.data)
+			}
+		case bytes.HasPrefix(p.data[p.pos:], []byte("/*")):
+			if i := bytes.Index(p.data[p.pos+2:], []byte("*/")); i >= 0 {
+				p.pos += i + 4
+			} else {
+				p.pos = len(p.data)
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (p *jsonParser) value() (*jsonNode, error) {
+	p.skip()
+	if p.pos >= len(p.data) {
+		return nil, p.errorf("unexpected end of data")
+	}
+	n := &jsonNode{start: p.pos}
+	switch p.data[p.pos] {
+	case '{':
+		n.kind = '{'
+		p.pos++
+		for first := true; ; first = false {
+			p.skip()
+			if p.pos < len(p.data) && p.data[p.pos] == '}' && first {
+				p.pos++
+				break
+			}
+			keyAt := p.pos
+			key, err := p.str()
+			if err != nil {
+				return nil, err
+			}
+			p.skip()
+			if p.pos >= len(p.data) || p.data[p.pos] != ':' {
+				return nil, p.errorf("expected ':' after object key")
+			}
+			p.pos++
+			kid, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			n.keys = append(n.keys, key)
+			n.keyAt = append(n.keyAt, keyAt)
+			n.kids = append(n.kids, kid)
+			if !p.next('}') {
+				return nil, p.errorf("expected ',' or '}' in object")
+			}
+			if p.data[p.pos-1] == '}' {
+				break
+			}
+		}
+	case '[':
+		n.kind = '['
+		p.pos++
+		for first := true; ; first = false {
+			p.skip()
+			if p.pos < len(p.data) && p.data[p.pos] == ']' && first {
+				p.pos++
+				break
+			}
+			kid, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			n.kids = append(n.kids, kid)
+			if !p.next(']') {
+				return nil, p.errorf("expected ',' or ']' in array")
+			}
+			if p.data[p.pos-1] == ']' {
+				break
+			}
+		}
+	case '"':
+		if _, err := p.str(); err != nil {
+			return nil, err
+		}
+	default:
+		for p.pos < len(p.data) && !bytes.ContainsRune([]byte(" \t\r\n,:]}/"), rune(p.data[p.pos])) {
+			p.pos++
+		}
+		if p.pos == n.start {
+			return nil, p.errorf("unexpected character")
+		}
+	}
+	n.end = p.pos
+	return n, nil
+}
+
+// next moves past the ',' between values or the given closing delimiter,
+// leaving the position just after it, false is returned if neither is found
+func (p *jsonParser) next(closing byte) bool {
+	p.skip()
+	if p.pos >= len(p.data) {
+		return false
+	}
+	if c := p.data[p.pos]; c == ',' || c == closing {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// str scans a JSON string and returns its decoded value
+func (p *jsonParser) str() (string, error) {
+	start := p.pos
+	if p.pos >= len(p.data) || p.data[p.pos] != '"' {
+		return "", p.errorf("expected string")
+	}
+	for p.pos++; p.pos < len(p.data); p.pos++ {
+		switch p.data[p.pos] {
+		case '\\':
+			p.pos++
+		case '"':
+			p.pos++
+			var s string
+			if err := json.Unmarshal(p.data[start:p.pos], &s); err != nil {
+				return "", p.errorf("invalid string")
+			}
+			return s, nil
+		}
+	}
+	return "", p.errorf("unterminated string")
+}
+
+// stripJSONComments returns a copy of the given JSON with any "//" and
+// "/* */" comments replaced by spaces (newlines are kept) so that byte
+// offsets into the result still match the original
+func stripJSONComments(data []byte) []byte {
+	if !bytes.Contains(data, []byte("/")) {
+		return data
+	}
+	res := make([]byte, len(data))
+	copy(res, data)
+	blank := func(start, end int) {
+		for i := start; i < end; i++ {
+			if res[i] != '\n' && res[i] != '\r' {
+				res[i] = ' '
+			}
+		}
+	}
+	for i := 0; i < len(res); i++ {
+		switch {
+		case res[i] == '"':
+			for i++; i < len(res) && res[i] != '"'; i++ {
+				if res[i] == '\\' {
+					i++
+				}
+			}
+		case bytes.HasPrefix(res[i:], []byte("//")):
+			end := bytes.IndexByte(res[i:], '\n')
+			if end < 0 {
+				end = len(res) - i
+			}
+			blank(i, i+end)
+			i += end
+		case bytes.HasPrefix(res[i:], []byte("/*")):
+			end := bytes.Index(res[i+2:], []byte("*/"))
+			if end < 0 {
+				end = len(res) - i - 2
+			} else {
+				end += 2
+			}
+			blank(i, i+2+end)
+			i += 1 + end
+		}
+	}
+	return res
+}
+
+// jsonEdit replaces the src bytes in [start,end) with text
+type jsonEdit struct {
+	start int
+	end   int
+	text  string
+}
+
+// jsonPatcher figures out the edits needed to move the src document from
+// the base encoding of the codebase to the new (nu) encoding
+type jsonPatcher struct {
+	src   []byte
+	base  []byte
+	nu    []byte
+	edits []jsonEdit
+}
+
+// patchJSON returns src with the differences between the base and nu
+// encodings of a codebase applied to it, base is expected to be what
+// src decodes to (as written by Defn.encodeJSON) so only the nodes that
+// differ between base and nu are touched in src
+func patchJSON(src, base, nu []byte) ([]byte, error) {
+	if bytes.Equal(base, nu) {
+		return src, nil
+	}
+	srcRoot, err := parseJSON(src)
+	if err != nil {
+		return nil, err
+	}
+	baseRoot, err := parseJSON(base)
+	if err != nil {
+		return nil, err
+	}
+	nuRoot, err := parseJSON(nu)
+	if err != nil {
+		return nil, err
+	}
+	p := &jsonPatcher{src: src, base: base, nu: nu}
+	p.diff(srcRoot, baseRoot, nuRoot)
+	sort.SliceStable(p.edits, func(i, j int) bool {
+		return p.edits[i].start > p.edits[j].start
+	})
+	res := append([]byte(nil), src...)
+	for _, e := range p.edits {
+		res = append(res[:e.start], append([]byte(e.text), res[e.end:]...)...)
+	}
+	return res, nil
+}
+
+func (p *jsonPatcher) diff(src, base, nu *jsonNode) {
+	if bytes.Equal(p.base[base.start:base.end], p.nu[nu.start:nu.end]) {
+		return
+	}
+	switch {
+	case src.kind == '{' && base.kind == '{' && nu.kind == '{':
+		p.diffObject(src, base, nu)
+	case src.kind == '[' && base.kind == '[' && nu.kind == '[':
+		p.diffArray(src, base, nu)
+	default:
+		p.replace(src, nu)
+	}
+}
+
+// diffObject recurses into the members found in both base and nu and
+// works out which src members need to be removed and which nu members
+// need to be added to src
+func (p *jsonPatcher) diffObject(src, base, nu *jsonNode) {
+	removed := make([]bool, len(src.kids))
+	var added []int
+	for i, key := range nu.keys {
+		b := base.member(key)
+		s := src.member(key)
+		switch {
+		case s < 0:
+			if b < 0 || !bytes.Equal(p.base[base.kids[b].start:base.kids[b].end], p.nu[nu.kids[i].start:nu.kids[i].end]) {
+				added = append(added, i)
+			}
+		case b < 0:
+			p.replace(src.kids[s], nu.kids[i])
+		default:
+			p.diff(src.kids[s], base.kids[b], nu.kids[i])
+		}
+	}
+	for _, key := range base.keys {
+		if nu.member(key) < 0 {
+			if s := src.member(key); s >= 0 {
+				removed[s] = true
+			}
+		}
+	}
+	p.adjust(src, nu, removed, added)
+}
+
+// diffArray matches up array entries, entries that are objects with a
+// "name" member (eg: pkgs) are matched by name, others by position
+func (p *jsonPatcher) diffArray(src, base, nu *jsonNode) {
+	removed := make([]bool, len(src.kids))
+	var added []int
+	baseIdx := make(map[string]int)
+	for i, kid := range base.kids {
+		if name, ok := p.name(p.base, kid); ok {
+			baseIdx[name] = i
+		}
+	}
+	matched := make([]bool, len(base.kids))
+	for i, kid := range nu.kids {
+		b := i
+		if name, ok := p.name(p.nu, kid); ok {
+			if b, ok = baseIdx[name]; !ok {
+				b = -1
+			}
+		}
+		if b < 0 || b >= len(base.kids) || b >= len(src.kids) || matched[b] {
+			added = append(added, i)
+			continue
+		}
+		matched[b] = true
+		p.diff(src.kids[b], base.kids[b], kid)
+	}
+	for i := range base.kids {
+		if !matched[i] && i < len(src.kids) {
+			removed[i] = true
+		}
+	}
+	p.adjust(src, nu, removed, added)
+}
+
+// name returns the "name" member value of an object node, if any
+func (p *jsonPatcher) name(data []byte, n *jsonNode) (string, bool) {
+	if n.kind != '{' {
+		return "", false
+	}
+	i := n.member("name")
+	if i < 0 {
+		return "", false
+	}
+	var name string
+	if err := json.Unmarshal(data[n.kids[i].start:n.kids[i].end], &name); err != nil {
+		return "", false
+	}
+	return name, true
+}
+
+// adjust removes the given src object members (or array entries) and adds
+// the given nu members (or entries) to the end of the src object (or array)
+func (p *jsonPatcher) adjust(src, nu *jsonNode, removed []bool, added []int) {
+	kept := -1
+	for i := range src.kids {
+		if !removed[i] {
+			kept = i
+			break
+		}
+	}
+	if kept < 0 && (len(added) > 0 || len(src.kids) == 0) {
+		p.replace(src, nu)
+		return
+	}
+	if kept < 0 {
+		empty := "{}"
+		if src.kind == '[' {
+			empty = "[]"
+		}
+		p.edits = append(p.edits, jsonEdit{src.start, src.end, empty})
+		return
+	}
+	if kept > 0 {
+		p.edits = append(p.edits, jsonEdit{p.kidStart(src, 0), p.kidStart(src, kept), ""})
+	}
+	last := kept
+	for i := kept + 1; i < len(src.kids); i++ {
+		if removed[i] {
+			p.edits = append(p.edits, jsonEdit{src.kids[i-1].end, src.kids[i].end, ""})
+		} else {
+			last = i
+		}
+	}
+	if len(added) == 0 {
+		return
+	}
+	// new members go after the last src member, one per line using the same
+	// indentation as the existing members (or inline if the src is inline)
+	inline := !bytes.Contains(p.src[src.start:src.end], []byte("\n"))
+	indent := lineIndent(p.src, p.kidStart(src, last))
+	unit := indentUnit(p.src, src)
+	var text bytes.Buffer
+	for _, i := range added {
+		if inline {
+			text.WriteString(", ")
+		} else {
+			text.WriteString(",\n" + indent)
+		}
+		if nu.kind == '{' {
+			// the encoder writes members as `"key": value`
+			text.Write(p.nu[nu.keyAt[i]:nu.kids[i].start])
+		}
+		text.WriteString(p.render(nu.kids[i], indent, unit, inline))
+	}
+	p.edits = append(p.edits, jsonEdit{src.kids[len(src.kids)-1].end, src.kids[len(src.kids)-1].end, text.String()})
+}
+
+// kidStart returns where the given member (key included) or entry starts
+func (p *jsonPatcher) kidStart(n *jsonNode, i int) int {
+	if n.kind == '{' {
+		return n.keyAt[i]
+	}
+	return n.kids[i].start
+}
+
+// replace swaps the src node for the nu node, indented to fit in
+func (p *jsonPatcher) replace(src, nu *jsonNode) {
+	inline := !bytes.Contains(p.src[src.start:src.end], []byte("\n")) && src.kind != 0 && len(src.kids) > 0
+	text := p.render(nu, lineIndent(p.src, src.start), indentUnit(p.src, src), inline)
+	p.edits = append(p.edits, jsonEdit{src.start, src.end, text})
+}
+
+// render returns the nu node's JSON indented for a line starting with the
+// given indent, or all on one line if inline is set
+func (p *jsonPatcher) render(nu *jsonNode, indent, unit string, inline bool) string {
+	var buf bytes.Buffer
+	compactNode(&buf, p.nu, nu)
+	if inline || nu.kind == 0 {
+		return spaceJSON(buf.Bytes())
+	}
+	var res bytes.Buffer
+	if err := json.Indent(&res, buf.Bytes(), indent, unit); err != nil {
+		return buf.String()
+	}
+	return res.String()
+}
+
+// compactNode writes the compacted JSON for the given node, dropping any
+// object members that are null or empty so that new entries added to a
+// codebase file are as compact as hand written ones would be
+func compactNode(buf *bytes.Buffer, data []byte, n *jsonNode) {
+	switch n.kind {
+	case '{', '[':
+		buf.WriteByte(n.kind)
+		sep := false
+		for i, kid := range n.kids {
+			var val bytes.Buffer
+			compactNode(&val, data, kid)
+			if n.kind == '{' {
+				switch val.String() {
+				case "null", `""`, "{}", "[]":
+					continue
+				}
+			}
+			if sep {
+				buf.WriteByte(',')
+			}
+			sep = true
+			if n.kind == '{' {
+				key, _ := json.Marshal(n.keys[i])
+				buf.Write(key)
+				buf.WriteByte(':')
+			}
+			buf.Write(val.Bytes())
+		}
+		if n.kind == '{' {
+			buf.WriteByte('}')
+		} else {
+			buf.WriteByte(']')
+		}
+	default:
+		json.Compact(buf, data[n.start:n.end])
+	}
+}
+
+// spaceJSON adds a space after the ':' and ',' separators in compacted
+// JSON so it reads like the hand written inline objects in codebase files
+func spaceJSON(compact []byte) string {
+	var buf bytes.Buffer
+	inStr := false
+	for i := 0; i < len(compact); i++ {
+		c := compact[i]
+		buf.WriteByte(c)
+		switch {
+		case inStr && c == '\\':
+			i++
+			buf.WriteByte(compact[i])
+		case c == '"':
+			inStr = !inStr
+		case !inStr && (c == ':' || c == ','):
+			buf.WriteByte(' ')
+		}
+	}
+	return buf.String()
+}
+
+// lineIndent returns the leading whitespace of the line containing pos
+func lineIndent(data []byte, pos int) string {
+	start := bytes.LastIndexByte(data[:pos], '\n') + 1
+	end := start
+	for end < pos && (data[end] == ' ' || data[end] == '\t') {
+		end++
+	}
+	return string(data[start:end])
+}
+
+// indentUnit guesses the indentation step used in the document, going by
+// the first nested line found in the given node, two spaces otherwise
+func indentUnit(data []byte, n *jsonNode) string {
+	outer := lineIndent(data, n.start)
+	for i, kid := range n.kids {
+		pos := kid.start
+		if n.kind == '{' {
+			pos = n.keyAt[i]
+		}
+		if bytes.LastIndexByte(data[n.start:pos], '\n') < 0 {
+			continue
+		}
+		inner := lineIndent(data, pos)
+		if len(inner) > len(outer) && strings.HasPrefix(inner, outer) {
+			return inner[len(outer):]
+		}
+	}
+	return "  "
+}
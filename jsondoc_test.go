@@ -0,0 +1,109 @@
+// Copyright © 2015 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codebase
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+var commentedCodebase = []byte(`// dvln codebase, keep pkgs sorted by name
+{ "name" : "dvln",
+  "desc" : "Multi-package and workspace management tool",
+  "attrs" : { "jobs" : "4", "linkalias" : "True" },
+  "vars" : { "dvln": "http://github.com/dvln" },
+  "pkgs" : [
+    { "id" : "22",
+      "name" : "dvln/lib/3rd/viper",   /* vendored */
+      "ws" : "src/dvln/lib/3rd/viper",
+      "vcs" : [ { "type" : "git", "repo" : { "rw": "{{.dvln}}/viper" } } ],
+      "status" : "active"
+    },
+    { "id" : "23",
+      "name" : "dvln/lib/out",
+      "ws" : "src/dvln/lib/out",
+      "vcs" : [ { "type" : "git", "repo" : { "rw": "{{.dvln}}/out" } } ],
+      "status" : "active"
+    }
+  ]
+}
+`)
+
+func TestDocUnchangedWrite(t *testing.T) {
+	for _, src := range [][]byte{codebaseExample, commentedCodebase} {
+		doc, err := ReadDoc(bytes.NewReader(src))
+		if err != nil {
+			t.Fatalf("Error reading codebase doc: %s", err)
+		}
+		w := new(bytes.Buffer)
+		if err = doc.Write(w); err != nil {
+			t.Fatalf("Error writing codebase doc: %s", err)
+		}
+		if !bytes.Equal(w.Bytes(), src) {
+			t.Fatalf("Unchanged codebase doc should be written as read, found:\n%s", w.String())
+		}
+	}
+}
+
+func TestDocMinimalWrite(t *testing.T) {
+	doc, err := ReadDoc(bytes.NewReader(commentedCodebase))
+	if err != nil {
+		t.Fatalf("Error reading codebase doc: %s", err)
+	}
+	doc.Defn.Desc = "Workspace management tool"
+	doc.Defn.Attrs["jobs"] = "8"
+	delete(doc.Defn.Attrs, "linkalias")
+	doc.Defn.Pkgs[1].Status = "retired"
+	w := new(bytes.Buffer)
+	if err = doc.Write(w); err != nil {
+		t.Fatalf("Error writing codebase doc: %s", err)
+	}
+	expected := strings.NewReplacer(
+		`"Multi-package and workspace management tool"`, `"Workspace management tool"`,
+		`{ "jobs" : "4", "linkalias" : "True" }`, `{ "jobs" : "8" }`,
+		`"ws" : "src/dvln/lib/out",
+      "vcs" : [ { "type" : "git", "repo" : { "rw": "{{.dvln}}/out" } } ],
+      "status" : "active"`, `"ws" : "src/dvln/lib/out",
+      "vcs" : [ { "type" : "git", "repo" : { "rw": "{{.dvln}}/out" } } ],
+      "status" : "retired"`,
+	).Replace(string(commentedCodebase))
+	if w.String() != expected {
+		t.Fatalf("Codebase doc write should only touch changed nodes, expected:\n%s\nfound:\n%s", expected, w.String())
+	}
+
+	// adding a pkg should add it to the end of the pkgs, leaving the rest as is
+	added := doc.Defn.Pkgs[0]
+	added.Name = "dvln/lib/util"
+	added.WS = "src/dvln/lib/util"
+	doc.Defn.Pkgs = append(doc.Defn.Pkgs, added)
+	w.Reset()
+	if err = doc.Write(w); err != nil {
+		t.Fatalf("Error writing codebase doc: %s", err)
+	}
+	written := w.String()
+	if !strings.HasPrefix(written, expected[:strings.LastIndex(expected, "}\n  ]")+1]) {
+		t.Fatalf("Adding a pkg should only append to the pkgs list, found:\n%s", written)
+	}
+	roundTrip, err := ReadDoc(w)
+	if err != nil {
+		t.Fatalf("Error reading back written codebase doc: %s\n%s", err, written)
+	}
+	if len(roundTrip.Defn.Pkgs) != 3 || roundTrip.Defn.Pkgs[2].Name != "dvln/lib/util" {
+		t.Fatalf("Added pkg not found reading back written codebase doc:\n%s", written)
+	}
+	if !strings.Contains(written, `"{{.dvln}}/viper"`) {
+		t.Fatalf("Added pkg should have used vars for its repo:\n%s", written)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright © 2015 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codebase
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/dvln/pkg"
+)
+
+// pathTrie is a trie of workspace path segments (eg: "src", "dvln", "lib"
+// for "src/dvln/lib"), a node has the pkg at that path, if any, and notes
+// if it is there via a pkg alias
+type pathTrie struct {
+	children map[string]*pathTrie
+	pkg      *pkg.Defn
+	alias    bool
+}
+
+// insert adds the given pkg at the given workspace path, a pkg at its
+// workspace path isn't replaced by a pkg alias for the same path
+func (t *pathTrie) insert(wsPath string, p *pkg.Defn, alias bool) {
+	node := t
+	for _, seg := range pathSegments(wsPath) {
+		child, ok := node.children[seg]
+		if !ok {
+			child = &pathTrie{}
+			if node.children == nil {
+				node.children = make(map[string]*pathTrie)
+			}
+			node.children[seg] = child
+		}
+		node = child
+	}
+	if node.pkg != nil && !node.alias && alias {
+		return
+	}
+	node.pkg, node.alias = p, alias
+}
+
+// longest returns the node with a pkg at the longest prefix of the given
+// workspace path, nil if no pkg path is a prefix of it
+func (t *pathTrie) longest(wsPath string) *pathTrie {
+	var found *pathTrie
+	node := t
+	if node.pkg != nil {
+		found = node
+	}
+	for _, seg := range pathSegments(wsPath) {
+		if node = node.children[seg]; node == nil {
+			break
+		}
+		if node.pkg != nil {
+			found = node
+		}
+	}
+	return found
+}
+
+// pathSegments returns the segments of the given workspace path (forward
+// slashes), none for the workspace root itself
+func pathSegments(wsPath string) []string {
+	wsPath = path.Clean(strings.Trim(wsPath, "/"))
+	if wsPath == "." {
+		return nil
+	}
+	return strings.Split(wsPath, "/")
+}
+
+// PkgIndex finds the pkg owning a path in a workspace, see PkgIndex() and
+// the Owner() method
+type PkgIndex struct {
+	wkspcRoot string
+	trie      *pathTrie
+}
+
+// PkgIndex returns an index of the codebase pkgs by the workspace paths
+// they own in the given workspace root dir, a pkg owns its workspace path
+// (see PkgWS()) and its alias paths (and everything under them).  The index
+// refers to the codebase pkgs so it is out of date if they are changed.
+// Pkgs whose path can't be worked out are left out and returned as
+// PkgErrors (with the index of the rest).
+func (cb *Defn) PkgIndex(wkspcRoot string) (*PkgIndex, error) {
+	index := &PkgIndex{wkspcRoot: wkspcRoot, trie: &pathTrie{}}
+	errs := make(PkgErrors)
+	for i := range cb.Pkgs {
+		p := &cb.Pkgs[i]
+		ws, err := cb.PkgWS(p)
+		if err != nil {
+			errs[p.Name] = err
+			continue
+		}
+		for _, aliasPath := range p.Aliases {
+			index.trie.insert(filepath.ToSlash(aliasPath), p, true)
+		}
+		index.trie.insert(ws, p, false)
+	}
+	if len(errs) != 0 {
+		return index, errs
+	}
+	return index, nil
+}
+
+// Owner returns the pkg owning the given path, ie: the pkg with the longest
+// workspace path (or alias path) that contains it, the alias bool is set
+// if it is owned via an alias path.  The path can be absolute (it must be
+// within the workspace root dir) or relative to the workspace root.  A nil
+// pkg is returned if no pkg owns the path.
+func (idx *PkgIndex) Owner(ownedPath string) (*pkg.Defn, bool) {
+	if filepath.IsAbs(ownedPath) {
+		root, err := filepath.Abs(idx.wkspcRoot)
+		if err != nil {
+			return nil, false
+		}
+		if ownedPath, err = filepath.Rel(root, ownedPath); err != nil {
+			return nil, false
+		}
+	}
+	ownedPath = path.Clean(filepath.ToSlash(ownedPath))
+	if ownedPath == ".." || strings.HasPrefix(ownedPath, "../") {
+		return nil, false
+	}
+	node := idx.trie.longest(ownedPath)
+	if node == nil {
+		return nil, false
+	}
+	return node.pkg, node.alias
+}
@@ -0,0 +1,84 @@
+// Copyright © 2015 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codebase
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/dvln/pkg"
+)
+
+func TestPkgIndex(t *testing.T) {
+	codebaseDefn := New()
+	if err := codebaseDefn.Read(bytes.NewReader(codebaseExample)); err != nil {
+		t.Fatalf("Read of the codebase failed: %s", err)
+	}
+	// a pkg nested in another and one whose alias is another's path
+	codebaseDefn.Pkgs = append(codebaseDefn.Pkgs,
+		pkg.Defn{Name: "viper/docs", WS: "src/dvln/lib/3rd/viper/docs"},
+		pkg.Defn{Name: "oldout", WS: "oldout", Aliases: map[string]string{"out": "src/dvln/lib/out"}},
+	)
+	wkspc := filepath.Join(string(filepath.Separator), "wkspc")
+	index, err := codebaseDefn.PkgIndex(wkspc)
+	if err != nil {
+		t.Fatalf("Pkg index failed: %s", err)
+	}
+	tests := []struct {
+		path  string
+		owner string
+		alias bool
+	}{
+		{"src/dvln/lib/3rd/viper", "dvln/lib/3rd/viper", false},
+		{"src/dvln/lib/3rd/viper/viper.go", "dvln/lib/3rd/viper", false},
+		{filepath.Join(wkspc, "src", "dvln", "lib", "3rd", "viper", "util.go"), "dvln/lib/3rd/viper", false},
+		{"src/dvln/lib/3rd/viper/docs/index.md", "viper/docs", false},
+		{"src/dvln/lib/3rd/viperish/x.go", "", false},
+		{"src/dvln/lib/olddir/viper/x.go", "dvln/lib/3rd/viper", true},
+		{"src/dvln/lib/out/out.go", "dvln/lib/out", false},
+		{"src/dvln/lib", "", false},
+		{"../wkspc/src/dvln/lib/out", "", false},
+		{filepath.Join(string(filepath.Separator), "elsewhere", "src", "dvln", "lib", "out"), "", false},
+	}
+	for _, test := range tests {
+		p, alias := index.Owner(test.path)
+		owner := ""
+		if p != nil {
+			owner = p.Name
+		}
+		if owner != test.owner || alias != test.alias {
+			t.Errorf("Owner of %q should be %q (alias: %v), found: %q (alias: %v)", test.path, test.owner, test.alias, owner, alias)
+		}
+	}
+}
+
+func TestPkgIndexMany(t *testing.T) {
+	codebaseDefn := New()
+	codebaseDefn.Pkgs = make([]pkg.Defn, 5000)
+	for i := range codebaseDefn.Pkgs {
+		codebaseDefn.Pkgs[i].Name = fmt.Sprintf("group%02d/pkg%04d", i%50, i)
+	}
+	index, err := codebaseDefn.PkgIndex("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range codebaseDefn.Pkgs {
+		name := codebaseDefn.Pkgs[i].Name
+		if p, _ := index.Owner(name + "/sub/dir/file.go"); p != &codebaseDefn.Pkgs[i] {
+			t.Fatalf("Expected pkg %s to own its files, found: %v", name, p)
+		}
+	}
+}
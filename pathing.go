@@ -0,0 +1,167 @@
+// Copyright © 2015 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codebase
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+	"text/template"
+
+	"github.com/dvln/out"
+	"github.com/dvln/pkg"
+)
+
+// pkgAttrs returns the given pkg attrs for use in templates, attrs set to
+// "True" or "False" (any case, unquoted YAML and TOML bools are read in as
+// these, see attrBools()) are bools so "{{if .GoPkg}}" works as expected,
+// other attrs (eg: "1") are left as strings
+func pkgAttrs(attrs map[string]string) map[string]interface{} {
+	data := make(map[string]interface{}, len(attrs))
+	for key, value := range attrs {
+		switch strings.ToLower(value) {
+		case "true":
+			data[key] = true
+		case "false":
+			data[key] = false
+		default:
+			data[key] = value
+		}
+	}
+	return data
+}
+
+// attrBools turns the bool attr values in the given codebase file map (as
+// decoded from JSON, TOML or YAML) into "True" and "False" strings, for
+// the codebase attrs and the attrs of each pkg, so they aren't decoded
+// into attrs as "1" and "0" (which pkgAttrs() leaves as strings)
+func attrBools(codebaseMap map[string]interface{}) {
+	maps := []interface{}{codebaseMap["attrs"]}
+	switch pkgs := codebaseMap["pkgs"].(type) {
+	case []interface{}:
+		for _, p := range pkgs {
+			if pkgMap, ok := p.(map[string]interface{}); ok {
+				maps = append(maps, pkgMap["attrs"])
+			}
+		}
+	case []map[string]interface{}:
+		// TOML arrays of tables (eg: "[[pkgs]]")
+		for _, pkgMap := range pkgs {
+			maps = append(maps, pkgMap["attrs"])
+		}
+	}
+	for _, m := range maps {
+		attrs, ok := m.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for key, value := range attrs {
+			if b, ok := value.(bool); ok {
+				attrs[key] = "False"
+				if b {
+					attrs[key] = "True"
+				}
+			}
+		}
+	}
+}
+
+// applyAttrsToPathing renders the given Pathing template with the given pkg
+// attrs (see pkgAttrs()), this is the applyVarsToField() method for Pathing
+func applyAttrsToPathing(desc, pathingName, pathingValue string, attrs map[string]string) (string, error) {
+	t := template.New(pathingName)
+	t, err := t.Parse(pathingValue)
+	if err != nil {
+		return "", out.WrapErrf(err, 3004, "Parsing problem applying templates to:\n%v\n  Pathing Template: %v", desc, pathingValue)
+	}
+	buf := new(bytes.Buffer)
+	err = t.Execute(buf, pkgAttrs(attrs))
+	if err != nil {
+		return "", out.WrapErrf(err, 3005, "Template execute problem with codebase pathing definition\n%v\n  Pathing Template: %v", desc, pathingValue)
+	}
+	return buf.String(), nil
+}
+
+// PkgPathing returns the codebase Pathing settings for the given pkg, ie:
+// each Pathing template rendered with the pkg attrs (eg: for a pkg with
+// the "GoPkg" attr "True" a "wkspc_pfx_dir" of "{{if .GoPkg}}src{{end}}"
+// is "src", for other pkgs it is "")
+func (cb *Defn) PkgPathing(p *pkg.Defn) (map[string]string, error) {
+	pathing := make(map[string]string, len(cb.Pathing))
+	for name, value := range cb.Pathing {
+		desc := fmt.Sprintf("  Pkg: %s\n  Pathing: %s", p.Name, name)
+		result, err := applyAttrsToPathing(desc, name, value, p.Attrs)
+		if err != nil {
+			return nil, err
+		}
+		pathing[name] = result
+	}
+	return pathing, nil
+}
+
+// PkgWS returns the final workspace path (forward slashes, relative to the
+// workspace root) of the given pkg, this is the pkg "ws" setting (or the
+// pkg name if not set) under the pkg "wkspc_pfx_dir" Pathing setting (see
+// PkgPathing()), ie: "{{if .GoPkg}}src{{end}}" puts Go pkgs under "src/"
+// (the prefix isn't added if the pkg "ws" setting already starts with it).
+// Paths outside the workspace root (eg: "../other") fail (error 3025).
+func (cb *Defn) PkgWS(p *pkg.Defn) (string, error) {
+	ws := p.WS
+	if ws == "" {
+		ws = p.Name
+	}
+	if pfxTmpl, ok := cb.Pathing["wkspc_pfx_dir"]; ok && pfxTmpl != "" {
+		desc := fmt.Sprintf("  Pkg: %s\n  Pathing: wkspc_pfx_dir", p.Name)
+		pfx, err := applyAttrsToPathing(desc, "wkspc_pfx_dir", pfxTmpl, p.Attrs)
+		if err != nil {
+			return "", err
+		}
+		pfx = strings.Trim(pfx, "/")
+		if pfx != "" && ws != pfx && !strings.HasPrefix(ws, pfx+"/") {
+			ws = path.Join(pfx, ws)
+		}
+	}
+	ws = path.Clean(ws)
+	if outsideWkspc(ws) {
+		return "", out.NewErrf(3025, "Pkg \"%s\" workspace path is outside the workspace root: %s", p.Name, ws)
+	}
+	return ws, nil
+}
+
+// outsideWkspc returns true if the given cleaned workspace path (forward
+// slashes, relative to the workspace root) is outside the workspace root
+func outsideWkspc(wsPath string) bool {
+	return wsPath == ".." || strings.HasPrefix(wsPath, "../")
+}
+
+// WkspcPaths returns the final workspace path (see PkgWS()) of each of the
+// codebase pkgs by pkg name, pkgs whose path can't be worked out are left
+// out and returned as PkgErrors
+func (cb *Defn) WkspcPaths() (map[string]string, error) {
+	paths := make(map[string]string, len(cb.Pkgs))
+	errs := make(PkgErrors)
+	for i := range cb.Pkgs {
+		ws, err := cb.PkgWS(&cb.Pkgs[i])
+		if err != nil {
+			errs[cb.Pkgs[i].Name] = err
+			continue
+		}
+		paths[cb.Pkgs[i].Name] = ws
+	}
+	if len(errs) != 0 {
+		return paths, errs
+	}
+	return paths, nil
+}
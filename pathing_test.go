@@ -0,0 +1,157 @@
+// Copyright © 2015 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codebase
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dvln/out"
+	"github.com/dvln/pkg"
+)
+
+func TestPkgWS(t *testing.T) {
+	cb := New()
+	cb.Pathing = map[string]string{"wkspc_pfx_dir": "{{if .GoPkg}}src{{end}}"}
+	cb.Pkgs = make([]pkg.Defn, 4)
+	cb.Pkgs[0].Name, cb.Pkgs[0].WS = "viper", "dvln/viper"
+	cb.Pkgs[0].Attrs = map[string]string{"GoPkg": "True"}
+	cb.Pkgs[1].Name, cb.Pkgs[1].WS = "out", "src/dvln/out"
+	cb.Pkgs[1].Attrs = map[string]string{"GoPkg": "True"}
+	cb.Pkgs[2].Name = "tools"
+	cb.Pkgs[2].Attrs = map[string]string{"GoPkg": "False"}
+	cb.Pkgs[3].Name, cb.Pkgs[3].WS = "docs", "docs/"
+	expected := []string{"src/dvln/viper", "src/dvln/out", "tools", "docs"}
+	for i := range cb.Pkgs {
+		ws, err := cb.PkgWS(&cb.Pkgs[i])
+		if err != nil || ws != expected[i] {
+			t.Errorf("Pkg %s workspace path should be %q, found: %q (%v)", cb.Pkgs[i].Name, expected[i], ws, err)
+		}
+	}
+	// "True" and "False" in any case are bools, false ones aren't taken as
+	// set strings, other values (eg: "0") are strings
+	for _, value := range []string{"false", "FALSE", "False"} {
+		p := pkg.Defn{Name: "tools", Attrs: map[string]string{"GoPkg": value}}
+		if ws, err := cb.PkgWS(&p); err != nil || ws != "tools" {
+			t.Errorf("Pkg with GoPkg %q workspace path should be \"tools\", found: %q (%v)", value, ws, err)
+		}
+	}
+	p := pkg.Defn{Name: "viper", Attrs: map[string]string{"GoPkg": "0"}}
+	if ws, err := cb.PkgWS(&p); err != nil || ws != "src/viper" {
+		t.Errorf("Pkg with GoPkg \"0\" workspace path should be \"src/viper\", found: %q (%v)", ws, err)
+	}
+
+	// numeric attrs are rendered as is
+	cb.Pathing["wkspc_pfx_dir"] = "v{{.Major}}"
+	p = pkg.Defn{Name: "lib", Attrs: map[string]string{"Major": "1"}}
+	if ws, err := cb.PkgWS(&p); err != nil || ws != "v1/lib" {
+		t.Errorf("Pkg with Major \"1\" workspace path should be \"v1/lib\", found: %q (%v)", ws, err)
+	}
+
+	// paths outside the workspace root fail, via "ws" or the prefix
+	p = pkg.Defn{Name: "outside", WS: "../../outside"}
+	if _, err := cb.PkgWS(&p); !out.IsError(err, nil, 3025) || !strings.Contains(err.Error(), "outside") {
+		t.Errorf("Pkg ws outside the workspace should fail (3025), found: %v", err)
+	}
+	cb.Pathing["wkspc_pfx_dir"] = "../.."
+	p = pkg.Defn{Name: "lib"}
+	if _, err := cb.PkgWS(&p); !out.IsError(err, nil, 3025) {
+		t.Errorf("Pkg prefix outside the workspace should fail (3025), found: %v", err)
+	}
+
+	cb.Pathing["wkspc_pfx_dir"] = "{{.GoPkg"
+	if _, err := cb.PkgWS(&cb.Pkgs[0]); !out.IsError(err, nil, 3004) || !strings.Contains(err.Error(), "Pkg: viper") {
+		t.Fatalf("Bad pathing templates should fail with the pkg noted, found: %v", err)
+	}
+}
+
+func TestPkgPathing(t *testing.T) {
+	codebaseDefn := New()
+	if err := codebaseDefn.Read(bytes.NewReader(codebaseExample)); err != nil {
+		t.Fatalf("Read of the codebase failed: %s", err)
+	}
+	codebaseDefn.Pathing["wkspc_doc_dir"] = "{{if .GoPkg}}doc/go{{else}}doc{{end}}"
+	pathing, err := codebaseDefn.PkgPathing(&codebaseDefn.Pkgs[0])
+	expected := map[string]string{"wkspc_pfx_dir": "src", "wkspc_doc_dir": "doc/go"}
+	if err != nil || !reflect.DeepEqual(pathing, expected) {
+		t.Fatalf("Expected the Go pkg pathing %v, found: %v (%v)", expected, pathing, err)
+	}
+	paths, err := codebaseDefn.WkspcPaths()
+	if err != nil || len(paths) != len(codebaseDefn.Pkgs) || paths["dvln/lib/3rd/viper"] != "src/dvln/lib/3rd/viper" {
+		t.Fatalf("Unexpected workspace paths: %v (%v)", paths, err)
+	}
+
+	// template errors have the pkg and Pathing setting noted
+	codebaseDefn.Pathing["wkspc_doc_dir"] = "{{.GoPkg.Nope}}"
+	_, err = codebaseDefn.PkgPathing(&codebaseDefn.Pkgs[0])
+	if !out.IsError(err, nil, 3005) || !strings.Contains(err.Error(), "Pkg: dvln/lib/3rd/viper\n  Pathing: wkspc_doc_dir") {
+		t.Fatalf("Expected a template execute error (3005) noting the pkg, found: %v", err)
+	}
+}
+
+func TestPkgWSYAML(t *testing.T) {
+	// unquoted YAML bools are bool attrs, numbers are strings
+	codebaseDefn := New()
+	err := codebaseDefn.ReadYAML(strings.NewReader(`name: yaml
+pathing:
+  wkspc_pfx_dir: "{{if .GoPkg}}src{{else}}v{{.Major}}{{end}}"
+pkgs:
+  - name: viper
+    attrs:
+      GoPkg: true
+  - name: tools
+    attrs:
+      GoPkg: false
+      Major: 1
+`))
+	if err != nil {
+		t.Fatalf("Read of the YAML codebase failed: %s", err)
+	}
+	paths, err := codebaseDefn.WkspcPaths()
+	expected := map[string]string{"viper": "src/viper", "tools": "v1/tools"}
+	if err != nil || !reflect.DeepEqual(paths, expected) {
+		t.Fatalf("Expected YAML codebase workspace paths %v, found: %v (%v)", expected, paths, err)
+	}
+}
+
+func TestPkgWSTOML(t *testing.T) {
+	// unquoted TOML bools are bool attrs, numbers are strings
+	codebaseDefn := New()
+	err := codebaseDefn.ReadTOML(strings.NewReader(`name = "toml"
+
+[pathing]
+wkspc_pfx_dir = "{{if .GoPkg}}src{{else}}v{{.Major}}{{end}}"
+
+[[pkgs]]
+name = "viper"
+[pkgs.attrs]
+GoPkg = true
+
+[[pkgs]]
+name = "tools"
+[pkgs.attrs]
+GoPkg = false
+Major = 1
+`))
+	if err != nil {
+		t.Fatalf("Read of the TOML codebase failed: %s", err)
+	}
+	paths, err := codebaseDefn.WkspcPaths()
+	expected := map[string]string{"viper": "src/viper", "tools": "v1/tools"}
+	if err != nil || !reflect.DeepEqual(paths, expected) {
+		t.Fatalf("Expected TOML codebase workspace paths %v, found: %v (%v)", expected, paths, err)
+	}
+}
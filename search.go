@@ -0,0 +1,383 @@
+// Copyright © 2015 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codebase
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dvln/out"
+	globs "github.com/dvln/viper"
+)
+
+// dvlnCfgDir returns the dvln config dir ("dvlnCfgDir" setting), this
+// defaults to ~/.dvlncfg if not set
+func dvlnCfgDir() string {
+	if dir := globs.GetString("dvlnCfgDir"); dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".dvlncfg")
+}
+
+// codebaseDirs returns the local dirs searched, in order, for codebase
+// files: any dirs listed in the "codebaseDirs" setting, the workspace
+// root dir ("wkspcRootDir", if in a workspace) and then the dvln config
+// dir (see dvlnCfgDir()), empty or duplicate entries are dropped
+func codebaseDirs() []string {
+	dirs := append([]string{}, globs.GetStringSlice("codebaseDirs")...)
+	dirs = append(dirs, globs.GetString("wkspcRootDir"), dvlnCfgDir())
+	seen := make(map[string]bool)
+	uniq := dirs[:0]
+	for _, dir := range dirs {
+		if dir == "" || seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		uniq = append(uniq, dir)
+	}
+	return uniq
+}
+
+// codebaseFileNames returns the file names a codebase file with the given
+// name may have, ie: the name itself if it has a codebase file extension
+// and then the name with each of the codebase file extensions added
+func codebaseFileNames(name string) []string {
+	var names []string
+	if hasCodebaseExt(name) {
+		names = append(names, name)
+	}
+	for _, cbExt := range codebaseFileExts {
+		names = append(names, name+cbExt)
+	}
+	return names
+}
+
+// hasCodebaseExt returns true if the given name ends in one of the codebase
+// file extensions (eg: "dvln.toml")
+func hasCodebaseExt(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, cbExt := range codebaseFileExts {
+		if ext == cbExt {
+			return true
+		}
+	}
+	return false
+}
+
+// codebasePath returns the codebase search path entries, these come from
+// the space separated "codebasePath" setting (DVLN_CODEBASE_PATH in the
+// env if not set), entries always use forward slashes on any platform
+func codebasePath() []string {
+	path := globs.GetString("codebasePath")
+	if path == "" {
+		path = os.Getenv("DVLN_CODEBASE_PATH")
+	}
+	return strings.Fields(path)
+}
+
+// offline returns true if no network access is allowed ("offline" setting),
+// remote codebases can then only be found in the local codebase caches
+func offline() bool {
+	return globs.GetBool("offline")
+}
+
+// localPath returns the local filesystem path for a codebase search path
+// entry (or a codebase selector) that is a local dir or a "file://" URL,
+// false is returned for remote entries, ie: "github.com/dvln" (a host, if
+// no such local file or dir exists and it doesn't end in a codebase file
+// extension, "dvln.toml" is local), "git+ssh://host.com/path/to/clones"
+// (any other URL scheme) or 'hub' and 'hub:<uri>' (reserved for future
+// user/central dvln hub use)
+func localPath(entry string) (string, bool) {
+	if strings.HasPrefix(entry, "file://") {
+		u, err := url.Parse(entry)
+		if err != nil || (u.Host != "" && u.Host != "localhost") {
+			return "", false
+		}
+		return filepath.FromSlash(u.Path), true
+	}
+	if strings.Contains(entry, "://") || entry == "hub" || strings.HasPrefix(entry, "hub:") {
+		return "", false
+	}
+	if !strings.HasPrefix(entry, "/") {
+		first := strings.SplitN(entry, "/", 2)[0]
+		if first != "." && first != ".." && strings.Contains(first, ".") && !hasCodebaseExt(entry) {
+			// a dotted first element is a host unless it is a local path
+			if _, err := os.Stat(filepath.FromSlash(entry)); err != nil {
+				return "", false
+			}
+		}
+	}
+	return filepath.FromSlash(entry), true
+}
+
+// prober checks for codebase files or dirs, noting every location tried
+// and every remote location skipped (uncached) in offline mode
+type prober struct {
+	tried   []string
+	skipped []string
+}
+
+// probe checks if the given path exists as a file (or as a dir, if dirOK
+// is set, as codebase pkg repo clones are dirs)
+func (p *prober) probe(path string, dirOK bool) (bool, error) {
+	p.tried = append(p.tried, path)
+	fi, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, out.WrapErrf(err, 3000, "Unable to check codebase location \"%s\"", path)
+	}
+	return dirOK || !fi.IsDir(), nil
+}
+
+// probeURI checks if a codebase exists at the given remote URI via the
+// fetcher registered for the URI scheme, remote problems (eg: a host that
+// can't be reached) are noted and treated as the codebase not being there
+// so the rest of the codebase search path can still be searched.  It
+// returns where the codebase was found (the URI) and the locality, in
+// offline mode the network isn't used, only a local cache of the codebase
+// (see Cacher) can be found (the cache path is returned).  The only error
+// returned is for the context being done (error 3020).
+func (p *prober) probeURI(ctx context.Context, uri string) (string, Locality, error) {
+	p.tried = append(p.tried, uri)
+	f, err := fetcherFor(uri)
+	if err != nil {
+		out.Debugf("Skipping codebase location \"%s\": %s\n", uri, err)
+		return "", NonExistent, nil
+	}
+	if offline() {
+		if c, ok := f.(Cacher); ok {
+			if cached := c.Cached(uri); cached != "" {
+				return cached, LocalDir, nil
+			}
+		}
+		out.Debugf("Skipping codebase location \"%s\" (offline and not cached)\n", uri)
+		p.skipped = append(p.skipped, uri)
+		return "", NonExistent, nil
+	}
+	found, err := f.Exists(ctx, uri)
+	if cerr := cancelErr(ctx, "search for codebase at "+uri); cerr != nil {
+		return "", NonExistent, cerr
+	}
+	if err != nil {
+		out.Debugf("Skipping codebase location \"%s\": %s\n", uri, err)
+		return "", NonExistent, nil
+	}
+	if !found {
+		return "", NonExistent, nil
+	}
+	return uri, RemoteURL, nil
+}
+
+// probeAll checks each of the given paths in order, returning the first
+// that exists ("" if none do)
+func (p *prober) probeAll(paths []string, dirOK bool) (string, error) {
+	for _, path := range paths {
+		found, err := p.probe(path, dirOK)
+		if err != nil {
+			return "", err
+		}
+		if found {
+			return path, nil
+		}
+	}
+	return "", nil
+}
+
+// repoPaths returns the paths a codebase pkg (repo clone dir or codebase
+// file) can have in a local codebase search path entry dir, ie: for the
+// 'dvln' codebase "<dir>/dvln", "<dir>/dvln.git" and then "<dir>/dvln"
+// with each of the codebase file extensions added
+func repoPaths(dir, name string) []string {
+	paths := []string{filepath.Join(dir, name), filepath.Join(dir, name+".git")}
+	for _, fileName := range codebaseFileNames(name) {
+		if fileName != name {
+			paths = append(paths, filepath.Join(dir, fileName))
+		}
+	}
+	return paths
+}
+
+// Candidate is a location a codebase was found at when searching for it
+// along the codebase search path, see Candidates().  Quick overview:
+//   URI: full path (on filesystem) or URL (if remote) of the codebase
+//   Locality: where it exists (LocalDir or RemoteURL)
+//   Index: index of the search path entry it was found via (see the
+//          SearchPath() routine), -1 if the selector was a path or URL
+//   Entry: the search path entry it was found via (or the selector)
+type Candidate struct {
+	URI      string
+	Locality Locality
+	Index    int
+	Entry    string
+}
+
+// searchEntry is an entry in the codebase search path, see SearchPath()
+type searchEntry struct {
+	entry    string // the search path entry as configured
+	dir      string // local dir for the entry, "" for remote entries
+	repos    bool   // codebase pkg repo clone dirs can be found via entry
+	fallback bool   // the final fallback of trying the name itself
+}
+
+// searchEntries returns the codebase search path entries, in order: the
+// codebasePath() entries, the codebaseDirs() and then the final fallback
+// of trying the codebase name itself (relative to the current dir)
+func searchEntries() []searchEntry {
+	var entries []searchEntry
+	for _, entry := range codebasePath() {
+		dir, _ := localPath(entry)
+		entries = append(entries, searchEntry{entry: entry, dir: dir, repos: true})
+	}
+	for _, dir := range codebaseDirs() {
+		entries = append(entries, searchEntry{entry: dir, dir: dir})
+	}
+	return append(entries, searchEntry{entry: ".", dir: ".", repos: true, fallback: true})
+}
+
+// SearchPath returns the ordered codebase search path entries, the index
+// of each entry is the Candidate Index for codebases found via the entry
+func SearchPath() []string {
+	var path []string
+	for _, e := range searchEntries() {
+		path = append(path, e.entry)
+	}
+	return path
+}
+
+// findCodebase looks for the given codebase, in this order:
+// - the selector itself, if an absolute path, URL or starts with a host
+// - each codebasePath() entry, see repoPaths() (or remoteURIs()) for the
+// locations tried in local (or remote) entries
+// - each of the codebaseDirs(), trying each of the codebaseFileNames()
+// - the name itself (codebase file or codebase pkg repo clone dir)
+// It returns the candidates found (codebase files or codebase pkg repo
+// dirs), stopping at the first unless all is set, every location that
+// was tried (in order) and any unexpected error that occurred.  In offline
+// mode remote entries only find codebases in the local caches and, if
+// nothing was found, the error lists the uncached remote locations.  The
+// search stops (error 3020) if the context is done.
+func findCodebase(ctx context.Context, name string, all bool) ([]Candidate, []string, error) {
+	p := &prober{}
+	var found []Candidate
+	if path, ok := localPath(name); ok && (filepath.IsAbs(path) || strings.HasPrefix(name, "file://")) {
+		uri, err := p.probeAll([]string{path}, true)
+		if uri != "" {
+			found = append(found, Candidate{URI: uri, Locality: LocalDir, Index: -1, Entry: name})
+		}
+		return found, p.tried, err
+	} else if !ok {
+		if uri := remoteURI(name); uri != "" {
+			at, locality, err := p.probeURI(ctx, uri)
+			if err != nil {
+				return found, p.tried, err
+			}
+			if at != "" {
+				found = append(found, Candidate{URI: at, Locality: locality, Index: -1, Entry: name})
+			}
+		}
+		return found, p.tried, p.offlineErr(name, found)
+	}
+	for i, e := range searchEntries() {
+		if err := cancelErr(ctx, "search for codebase "+name); err != nil {
+			return found, p.tried, err
+		}
+		var paths []string
+		switch {
+		case e.dir == "":
+			for _, uri := range remoteURIs(e.entry, name) {
+				at, locality, err := p.probeURI(ctx, uri)
+				if err != nil {
+					return found, p.tried, err
+				}
+				if at != "" {
+					found = append(found, Candidate{URI: at, Locality: locality, Index: i, Entry: e.entry})
+					if !all {
+						return found, p.tried, nil
+					}
+				}
+			}
+		case e.fallback:
+			paths = []string{filepath.FromSlash(name)}
+		case e.repos:
+			paths = repoPaths(e.dir, filepath.FromSlash(name))
+		default:
+			for _, fileName := range codebaseFileNames(name) {
+				paths = append(paths, filepath.Join(e.dir, fileName))
+			}
+		}
+		for _, path := range paths {
+			ok, err := p.probe(path, e.repos)
+			if err != nil {
+				return found, p.tried, err
+			}
+			if ok {
+				found = append(found, Candidate{URI: path, Locality: LocalDir, Index: i, Entry: e.entry})
+				if !all {
+					return found, p.tried, nil
+				}
+			}
+		}
+	}
+	return found, p.tried, p.offlineErr(name, found)
+}
+
+// offlineErr returns the error used when, in offline mode, a codebase was
+// not found but might have been at one of the (uncached) remote locations
+// skipped, nil is returned otherwise
+func (p *prober) offlineErr(name string, found []Candidate) error {
+	if len(found) != 0 || len(p.skipped) == 0 {
+		return nil
+	}
+	return offlineErr(name, p.skipped)
+}
+
+// offlineErr returns the error used when a codebase is only available
+// remotely (the given URI's) and network access isn't allowed (offline)
+func offlineErr(name string, uris []string) error {
+	return out.NewErrf(3019, "Codebase \"%s\" not available offline (not cached), it needs remote access to:\n  %s", name, strings.Join(uris, "\n  "))
+}
+
+// codebaseFile returns the codebase file to read for the given codebase
+// location, which is the location itself if a file, otherwise it is a
+// codebase pkg repo clone dir and the codebase file within it is found,
+// ie: "<dir>/dvln.codebase" (or .json, .toml, .yaml, .yml) for 'dvln'
+func codebaseFile(location, name string) (string, []string, error) {
+	p := &prober{}
+	fi, err := os.Stat(location)
+	if err != nil || !fi.IsDir() {
+		return location, nil, nil
+	}
+	var paths []string
+	for _, fileName := range codebaseFileNames(name) {
+		paths = append(paths, filepath.Join(location, fileName))
+	}
+	found, err := p.probeAll(paths, false)
+	return found, p.tried, err
+}
+
+// notFoundErr returns the error used when a codebase can't be found, it
+// lists every location that was tried
+func notFoundErr(name string, tried []string) error {
+	return out.NewErrf(3010, "Codebase \"%s\" not found, looked in:\n  %s", name, strings.Join(tried, "\n  "))
+}
@@ -0,0 +1,430 @@
+// Copyright © 2015 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codebase
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dvln/out"
+	globs "github.com/dvln/viper"
+)
+
+// setGlobs adjusts the given (viper) settings for a test, the returned
+// func puts the original settings back
+func setGlobs(settings map[string]interface{}) func() {
+	orig := make(map[string]interface{})
+	for key, val := range settings {
+		orig[key] = globs.Get(key)
+		globs.Set(key, val)
+	}
+	return func() {
+		for key, val := range orig {
+			globs.Set(key, val)
+		}
+	}
+}
+
+func TestCodebaseSearchDirs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "codebase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfgDir := filepath.Join(dir, "cfg")
+	wkspcDir := filepath.Join(dir, "wkspc")
+	extraDir := filepath.Join(dir, "extra")
+	for _, d := range []string{cfgDir, wkspcDir, extraDir} {
+		if err = os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer setGlobs(map[string]interface{}{
+		"codebaseDirs": []string{extraDir},
+		"wkspcRootDir": wkspcDir,
+		"dvlnCfgDir":   cfgDir,
+	})()
+
+	// codebase files in the dvln config dir, in mixed formats, are found
+	if err = ioutil.WriteFile(filepath.Join(cfgDir, "dvln.yml"), codebaseYAMLExample, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(cfgDir, "other.codebase"), codebaseTOMLExample, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cbFile, locality, err := New().Exists("dvln")
+	if err != nil || locality != LocalDir || cbFile != filepath.Join(cfgDir, "dvln.yml") {
+		t.Fatalf("Expected to find dvln.yml in the cfg dir, found: %s, %v, %v", cbFile, locality, err)
+	}
+	codebaseDefn := New()
+	if err = codebaseDefn.Get("other"); err != nil || codebaseDefn.Name != "dvln" {
+		t.Fatalf("Expected to get the other.codebase TOML file, found: %s, %v", codebaseDefn.Name, err)
+	}
+
+	// the workspace and then codebaseDirs dirs come first
+	if err = ioutil.WriteFile(filepath.Join(wkspcDir, "dvln.json"), codebaseExample, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if cbFile, _, _ = New().Exists("dvln"); cbFile != filepath.Join(wkspcDir, "dvln.json") {
+		t.Fatalf("Expected to find dvln.json in the workspace dir, found: %s", cbFile)
+	}
+	if err = ioutil.WriteFile(filepath.Join(extraDir, "dvln.codebase"), codebaseExample, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if cbFile, _, _ = New().Exists("dvln"); cbFile != filepath.Join(extraDir, "dvln.codebase") {
+		t.Fatalf("Expected to find dvln.codebase in the codebaseDirs dir, found: %s", cbFile)
+	}
+
+	// a missing codebase should list all the places looked in
+	codebaseDefn = New()
+	err = codebaseDefn.Get("missing")
+	if !out.IsError(err, nil, 3010) {
+		t.Fatalf("Missing codebase should fail with error 3010, found: %v", err)
+	}
+	for _, d := range []string{extraDir, wkspcDir, cfgDir} {
+		if !strings.Contains(err.Error(), filepath.Join(d, "missing.yaml")) {
+			t.Errorf("Missing codebase error should list the %s dir:\n%s", d, err)
+		}
+	}
+	if codebaseDefn.Name != "generated" {
+		t.Fatalf("Missing codebase should be generated, found: %s", codebaseDefn.Name)
+	}
+	// but not asking for a codebase is fine
+	if err = New().Get(""); err != nil {
+		t.Fatalf("No codebase should not be an error, found: %v", err)
+	}
+}
+
+func TestLocalPath(t *testing.T) {
+	tests := []struct {
+		entry string
+		path  string
+		local bool
+	}{
+		{"/some/local/dir", filepath.FromSlash("/some/local/dir"), true},
+		{"file:///some/local/dir", filepath.FromSlash("/some/local/dir"), true},
+		{"file://localhost/some/dir", filepath.FromSlash("/some/dir"), true},
+		{"some/rel/dir", filepath.FromSlash("some/rel/dir"), true},
+		{"../rel/dir", filepath.FromSlash("../rel/dir"), true},
+		{"github.com/dvln", "", false},
+		{"git+ssh://host.com/path/to/clones", "", false},
+		{"file://host.com/path", "", false},
+		{"hub", "", false},
+		{"hub:http://hub.dvln.org", "", false},
+	}
+	for _, test := range tests {
+		path, local := localPath(test.entry)
+		if path != test.path || local != test.local {
+			t.Errorf("Local path for %s should be %q (%v), found: %q (%v)", test.entry, test.path, test.local, path, local)
+		}
+	}
+
+	// a dotted first element is only a host if there's no such local path,
+	// names with a codebase file extension are always local
+	dir, err := ioutil.TempDir("", "codebase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer testChdir(t, dir)()
+	if path, local := localPath("dvln.org"); path != "" || local {
+		t.Errorf("Local path for a missing dvln.org should be a host, found: %q (%v)", path, local)
+	}
+	if err = os.Mkdir("dvln.org", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if path, local := localPath("dvln.org"); path != "dvln.org" || !local {
+		t.Errorf("Local path for dvln.org should be %q (true), found: %q (%v)", "dvln.org", path, local)
+	}
+	if path, local := localPath("dvln.toml"); path != "dvln.toml" || !local {
+		t.Errorf("Local path for a missing dvln.toml should be %q (true), found: %q (%v)", "dvln.toml", path, local)
+	}
+}
+
+// testChdir changes to the given dir, returning a func to change back
+func testChdir(t *testing.T, dir string) func() {
+	orig, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		if err := os.Chdir(orig); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCodebasePathSearch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "codebase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	emptyDir := filepath.Join(dir, "empty")
+	cloneDir := filepath.Join(dir, "clones", "dvln")
+	bareDir := filepath.Join(dir, "bare", "dvln.git")
+	for _, d := range []string{emptyDir, cloneDir, bareDir} {
+		if err = os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = ioutil.WriteFile(filepath.Join(cloneDir, "dvln.toml"), codebaseTOMLExample, 0644); err != nil {
+		t.Fatal(err)
+	}
+	codebasePath := strings.Join([]string{
+		"git+file://" + filepath.ToSlash(emptyDir),
+		"file://" + filepath.ToSlash(emptyDir),
+		filepath.ToSlash(filepath.Join(dir, "clones")),
+		filepath.ToSlash(filepath.Join(dir, "bare")),
+	}, " ")
+	defer setGlobs(map[string]interface{}{
+		"codebasePath": codebasePath,
+		"codebaseDirs": []string{},
+		"wkspcRootDir": "",
+		"dvlnCfgDir":   emptyDir,
+	})()
+
+	// the first entry with the codebase pkg wins, the remote entry doesn't
+	// have it and the codebase file is found in the codebase pkg clone
+	cbURI, locality, err := New().Exists("dvln")
+	if err != nil || locality != LocalDir || cbURI != cloneDir {
+		t.Fatalf("Expected to find the dvln clone dir, found: %s, %v, %v", cbURI, locality, err)
+	}
+	codebaseDefn := New()
+	if err = codebaseDefn.Get("dvln"); err != nil || codebaseDefn.Pkgs[0].Name != "dvln/lib/3rd/viper" {
+		t.Fatalf("Expected to get the TOML codebase from the dvln clone dir, found: %v", err)
+	}
+
+	// next in line is the "[.git]" suffixed bare clone
+	if err = os.RemoveAll(cloneDir); err != nil {
+		t.Fatal(err)
+	}
+	if cbURI, _, _ = New().Exists("dvln"); cbURI != bareDir {
+		t.Fatalf("Expected to find the dvln.git dir, found: %s", cbURI)
+	}
+
+	// the selector can be a file:// URL or absolute path itself
+	cbURI, locality, err = New().Exists("file://" + filepath.ToSlash(bareDir))
+	if err != nil || locality != LocalDir || cbURI != bareDir {
+		t.Fatalf("Expected to find the dvln.git dir via file:// URL, found: %s, %v, %v", cbURI, locality, err)
+	}
+	_, locality, err = New().Exists(filepath.Join(dir, "nope"))
+	if locality != NonExistent || !out.IsError(err, nil, 3010) {
+		t.Fatalf("Expected not to find a missing absolute path, found: %v, %v", locality, err)
+	}
+	if strings.Count(err.Error(), "\n  ") != 1 {
+		t.Fatalf("Only the absolute path itself should have been tried:\n%s", err)
+	}
+
+	// a codebase file in the current dir is found (not taken for a host),
+	// offline too as no remote is involved
+	defer testChdir(t, dir)()
+	if err = ioutil.WriteFile("dvln.toml", codebaseTOMLExample, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, offline := range []bool{false, true} {
+		restore := setGlobs(map[string]interface{}{"offline": offline})
+		cbURI, locality, err = New().Exists("dvln.toml")
+		restore()
+		if err != nil || locality != LocalDir || cbURI != "dvln.toml" {
+			t.Fatalf("Expected to find dvln.toml in the current dir (offline: %v), found: %s, %v, %v", offline, cbURI, locality, err)
+		}
+	}
+	codebaseDefn = New()
+	if err = codebaseDefn.Get("dvln.toml"); err != nil || codebaseDefn.Name != "dvln" {
+		t.Fatalf("Expected to get the dvln.toml codebase in the current dir, found: %v", err)
+	}
+}
+
+func TestCodebaseFileNameSearch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "codebase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	searchDir := filepath.Join(dir, "codebases")
+	emptyDir := filepath.Join(dir, "empty")
+	for _, d := range []string{searchDir, emptyDir} {
+		if err = os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cbFile := filepath.Join(searchDir, "dvln.toml")
+	if err = ioutil.WriteFile(cbFile, codebaseTOMLExample, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer setGlobs(map[string]interface{}{
+		"codebasePath": "",
+		"codebaseDirs": []string{searchDir},
+		"wkspcRootDir": "",
+		"dvlnCfgDir":   emptyDir,
+	})()
+	defer testChdir(t, emptyDir)()
+
+	// codebase file names are searched for, not taken for hosts (offline
+	// too, as no remote is involved)
+	for _, offline := range []bool{false, true} {
+		restore := setGlobs(map[string]interface{}{"offline": offline})
+		cbURI, locality, err := New().Exists("dvln.toml")
+		restore()
+		if err != nil || locality != LocalDir || cbURI != cbFile {
+			t.Fatalf("Expected to find dvln.toml in the search dir (offline: %v), found: %s, %v, %v", offline, cbURI, locality, err)
+		}
+	}
+	codebaseDefn := New()
+	if err = codebaseDefn.Get("dvln.toml"); err != nil || codebaseDefn.Name != "dvln" {
+		t.Fatalf("Expected to get the dvln.toml codebase from the search dir, found: %v", err)
+	}
+}
+
+func TestCodebaseCandidates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "codebase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfgDir := filepath.Join(dir, "cfg")
+	cloneDir := filepath.Join(dir, "clones", "dvln")
+	bareDir := filepath.Join(dir, "bare", "dvln.git")
+	for _, d := range []string{cfgDir, cloneDir, bareDir} {
+		if err = os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = ioutil.WriteFile(filepath.Join(cfgDir, "dvln.json"), codebaseExample, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer setGlobs(map[string]interface{}{
+		"codebasePath": "git+file://" + filepath.ToSlash(cfgDir) + " " + filepath.Join(dir, "clones") + " " + filepath.Join(dir, "bare"),
+		"codebaseDirs": []string{},
+		"wkspcRootDir": "",
+		"dvlnCfgDir":   cfgDir,
+	})()
+
+	candidates, err := New().Candidates("dvln")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Candidate{
+		{URI: cloneDir, Locality: LocalDir, Index: 1, Entry: filepath.Join(dir, "clones")},
+		{URI: bareDir, Locality: LocalDir, Index: 2, Entry: filepath.Join(dir, "bare")},
+		{URI: filepath.Join(cfgDir, "dvln.json"), Locality: LocalDir, Index: 3, Entry: cfgDir},
+	}
+	if !reflect.DeepEqual(candidates, expected) {
+		t.Fatalf("Expected candidates:\n%+v\nfound:\n%+v", expected, candidates)
+	}
+	searchPath := SearchPath()
+	if len(searchPath) != 5 || searchPath[3] != cfgDir || searchPath[4] != "." {
+		t.Fatalf("Unexpected codebase search path: %v", searchPath)
+	}
+	// the winner is the one Exists() resolves to
+	if cbURI, _, _ := New().Exists("dvln"); cbURI != candidates[0].URI {
+		t.Fatalf("Exists should resolve to the first candidate, found: %s", cbURI)
+	}
+	if _, err = New().Candidates("missing"); !out.IsError(err, nil, 3010) {
+		t.Fatalf("Missing codebase candidates should fail with error 3010, found: %v", err)
+	}
+}
+
+func TestOffline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "codebase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldCommit, newCommit := testCodebaseRepo(t, filepath.Join(dir, "clones", "dvln"), "dvln.codebase")
+	testGit(t, dir, "clone", "-q", "--bare", filepath.Join(dir, "clones", "dvln"), filepath.Join(dir, "remote", "dvln.git"))
+	remote := "git+file://" + filepath.ToSlash(filepath.Join(dir, "remote"))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/codebases/web.toml" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(codebaseTOMLExample)
+	}))
+	defer srv.Close()
+	localDir := filepath.Join(dir, "local")
+	if err = os.MkdirAll(localDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(localDir, "local.json"), codebaseExample, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer setGlobs(map[string]interface{}{
+		"codebasePath": "git+ssh://unreachable.invalid/clones " + remote + " " + srv.URL + "/codebases",
+		"codebaseDirs": []string{localDir},
+		"wkspcRootDir": "",
+		"dvlnCfgDir":   filepath.Join(dir, "cfg"),
+		"offline":      true,
+	})()
+
+	// nothing is cached yet, local codebases are still found but remote ones
+	// fail with an error listing the remote locations needed
+	if cbURI, locality, err := New().Exists("local"); err != nil || locality != LocalDir || cbURI != filepath.Join(localDir, "local.json") {
+		t.Fatalf("Expected to find the local codebase offline, found: %s, %v, %v", cbURI, locality, err)
+	}
+	for _, sel := range []string{"dvln", "web", remote + "/dvln.git"} {
+		_, locality, err := New().Exists(sel)
+		if locality != NonExistent || !out.IsError(err, nil, 3019) {
+			t.Fatalf("Uncached %s should fail offline with error 3019, found: %v, %v", sel, locality, err)
+		}
+	}
+	if _, _, err = New().Exists("dvln"); !strings.Contains(err.Error(), remote+"/dvln.git") {
+		t.Fatalf("Offline error should list the remote locations needed:\n%s", err)
+	}
+
+	// once cached (online) the remote codebases can be used offline
+	globs.Set("offline", false)
+	for _, sel := range []string{"dvln", "web"} {
+		if err = New().Get(sel); err != nil {
+			t.Fatalf("Get of %s online failed: %s", sel, err)
+		}
+	}
+	globs.Set("offline", true)
+	if err = os.RemoveAll(filepath.Join(dir, "remote")); err != nil {
+		t.Fatal(err)
+	}
+	srv.Close()
+	cbURI, locality, err := New().Exists("dvln")
+	if err != nil || locality != LocalDir || !strings.HasPrefix(cbURI, filepath.Join(dir, "cfg", "codebase")) {
+		t.Fatalf("Expected to find the cached dvln codebase offline, found: %s, %v, %v", cbURI, locality, err)
+	}
+	tests := []struct {
+		sel    string
+		name   string
+		pkgRev string
+	}{
+		{"dvln", "dvln", newCommit},
+		{"dvln@v1", "old", oldCommit},
+		{"web", "dvln", ""},
+	}
+	for _, test := range tests {
+		codebaseDefn := New()
+		if err = codebaseDefn.Get(test.sel); err != nil {
+			t.Fatalf("Get of cached %s offline failed: %s", test.sel, err)
+		}
+		if codebaseDefn.Name != test.name || string(codebaseDefn.PkgRev) != test.pkgRev {
+			t.Errorf("Get of cached %s offline should have name %s at rev %q, found: %s at %q", test.sel, test.name, test.pkgRev, codebaseDefn.Name, codebaseDefn.PkgRev)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright © 2015 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codebase
+
+import (
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/dvln/out"
+)
+
+// Selector is a parsed codebase version selector (the codebaseVerSel
+// given to Exists() and Get()), the grammar is:
+//   <name|path|URL>[@<revision>][:<devline>]
+// eg: "dvln", "dvln@v1.2.0", "dvln:main", "dvln@a1b2c3d:main" or
+// "http://github.com/dvln/dvln.git@v1.2.0" or "/some/dir/dvln:main".
+// The revision and devline can't themselves contain '@' or ':' (they can
+// contain '/' though, eg: "dvln@release/1.2") and URL's must use the
+// "<scheme>://" form (scp-like "git@host:path" URL's aren't supported).
+// Quick overview:
+//   Location: the codebase name, path or URL, eg: "dvln"
+//   Name: the codebase name, the last element of the location minus any
+//         ".git" or codebase file extension, eg: "dvln"
+//   Revision: optional; the revision of the codebase pkg to use, if not
+//             given the default VCS rev is used
+//   Devline: optional; the development line of the codebase to use (not
+//            supported by Get() yet)
+type Selector struct {
+	Location string
+	Name     string
+	Revision string
+	Devline  string
+}
+
+// schemeRE matches the "<scheme>://" at the start of URL selectors
+var schemeRE = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9+.-]*://`)
+
+// ParseSelector parses the given codebase version selector, see Selector
+// for the grammar, an error is returned for an invalid selector
+func ParseSelector(codebaseVerSel string) (*Selector, error) {
+	// any URL scheme and host (which may have a "user@" or ":port") is
+	// skipped so only the path can carry the revision and devline
+	start := 0
+	if loc := schemeRE.FindStringIndex(codebaseVerSel); loc != nil {
+		start = loc[1]
+		if i := strings.Index(codebaseVerSel[start:], "/"); i >= 0 {
+			start += i
+		} else {
+			start = len(codebaseVerSel)
+		}
+	}
+	sel := &Selector{Location: codebaseVerSel}
+	rest := codebaseVerSel[start:]
+	if i := strings.IndexAny(rest, "@:"); i >= 0 {
+		sel.Location = codebaseVerSel[:start+i]
+		suffix := rest[i:]
+		if strings.HasPrefix(suffix, "@") {
+			sel.Revision = suffix[1:]
+			if j := strings.Index(sel.Revision, ":"); j >= 0 {
+				sel.Devline = sel.Revision[j+1:]
+				sel.Revision = sel.Revision[:j]
+				if sel.Devline == "" {
+					return nil, selectorErr(codebaseVerSel, "empty devline after ':'")
+				}
+			}
+			if sel.Revision == "" {
+				return nil, selectorErr(codebaseVerSel, "empty revision after '@'")
+			}
+		} else {
+			sel.Devline = suffix[1:]
+			if sel.Devline == "" {
+				return nil, selectorErr(codebaseVerSel, "empty devline after ':'")
+			}
+		}
+		if strings.ContainsAny(sel.Revision+sel.Devline, "@:") {
+			return nil, selectorErr(codebaseVerSel, "the revision must come before the devline, neither can use '@' or ':'")
+		}
+	}
+	name := strings.TrimSuffix(path.Base(strings.TrimRight(sel.Location[start:], "/")), ".git")
+	for _, ext := range codebaseFileExts {
+		name = strings.TrimSuffix(name, ext)
+	}
+	if sel.Location[start:] == "" || name == "" || name == "." || name == "/" {
+		return nil, selectorErr(codebaseVerSel, "no codebase name")
+	}
+	sel.Name = name
+	return sel, nil
+}
+
+// String returns the selector in its "<location>[@<rev>][:<devline>]" form
+func (sel *Selector) String() string {
+	s := sel.Location
+	if sel.Revision != "" {
+		s += "@" + sel.Revision
+	}
+	if sel.Devline != "" {
+		s += ":" + sel.Devline
+	}
+	return s
+}
+
+func selectorErr(codebaseVerSel, problem string) error {
+	return out.NewErrf(3011, "Invalid codebase selector \"%s\": %s", codebaseVerSel, problem)
+}
@@ -0,0 +1,55 @@
+// Copyright © 2015 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codebase
+
+import (
+	"testing"
+
+	"github.com/dvln/out"
+)
+
+func TestParseSelector(t *testing.T) {
+	tests := []struct {
+		sel      string
+		expected Selector
+	}{
+		{"dvln", Selector{Location: "dvln", Name: "dvln"}},
+		{"dvln@v1.2.0", Selector{Location: "dvln", Name: "dvln", Revision: "v1.2.0"}},
+		{"dvln:main", Selector{Location: "dvln", Name: "dvln", Devline: "main"}},
+		{"dvln@release/1.2:main", Selector{Location: "dvln", Name: "dvln", Revision: "release/1.2", Devline: "main"}},
+		{"github.com/dvln/dvln@a1b2c3d", Selector{Location: "github.com/dvln/dvln", Name: "dvln", Revision: "a1b2c3d"}},
+		{"http://github.com/dvln/dvln.git@v1:main", Selector{Location: "http://github.com/dvln/dvln.git", Name: "dvln", Revision: "v1", Devline: "main"}},
+		{"git+ssh://git@host.com:22/path/tools", Selector{Location: "git+ssh://git@host.com:22/path/tools", Name: "tools"}},
+		{"file:///some/dir/dvln.codebase:dev", Selector{Location: "file:///some/dir/dvln.codebase", Name: "dvln", Devline: "dev"}},
+		{"/some/dir/dvln.toml", Selector{Location: "/some/dir/dvln.toml", Name: "dvln"}},
+	}
+	for _, test := range tests {
+		sel, err := ParseSelector(test.sel)
+		if err != nil {
+			t.Errorf("Selector %s failed to parse: %s", test.sel, err)
+			continue
+		}
+		if *sel != test.expected {
+			t.Errorf("Selector %s should parse to %+v, found: %+v", test.sel, test.expected, *sel)
+		}
+		if sel.String() != test.sel {
+			t.Errorf("Selector %s should print as is, found: %s", test.sel, sel)
+		}
+	}
+	for _, bad := range []string{"", "dvln@", "dvln:", "dvln@v1:", "dvln:main@v1", "@v1", "http://host.com", "dvln@v1:a:b"} {
+		if _, err := ParseSelector(bad); !out.IsError(err, nil, 3011) {
+			t.Errorf("Selector %q should fail to parse with error 3011, found: %v", bad, err)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright © 2015 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codebase
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dvln/pkg"
+)
+
+// PkgState is the state of a codebase pkg in a workspace, states other
+// than PkgMissing are combined with PkgPresent (eg: a clone with a wrong
+// remote URL is "PkgPresent | PkgWrongRemote"), see the Status() method
+type PkgState int
+
+const (
+	// PkgMissing indicates there is no clone at the pkg workspace path
+	PkgMissing PkgState = 1 << iota
+	// PkgPresent indicates the pkg is cloned at its workspace path
+	PkgPresent
+	// PkgWrongRemote indicates the repo or a remote is missing or has the
+	// wrong URL in the clone
+	PkgWrongRemote
+	// PkgExtraRemotes indicates the clone has remotes the pkg doesn't
+	PkgExtraRemotes
+	// PkgWrongVCS indicates the clone isn't of the pkg VCS type
+	PkgWrongVCS
+)
+
+// PkgStatus is the state of a codebase pkg in a workspace.  Quick overview:
+//   Pkg: name of the pkg
+//   WS: workspace path of the pkg (see PkgWS())
+//   State: state of the pkg clone (see PkgState)
+//   WrongRemotes: names of remotes missing or with the wrong URL (the repo
+//          itself is "origin" for git, "default" for hg)
+//   ExtraRemotes: names of remotes in the clone the pkg doesn't have
+type PkgStatus struct {
+	Pkg          string
+	WS           string
+	State        PkgState
+	WrongRemotes []string
+	ExtraRemotes []string
+}
+
+// WkspcStatus is the state of a workspace compared to a codebase, there is
+// a PkgStatus for each pkg (in codebase order) and the workspace paths of
+// any clones the codebase doesn't know about (sorted), see Status()
+type WkspcStatus struct {
+	Pkgs    []PkgStatus
+	Unknown []string
+}
+
+// Consistent returns true if the workspace matches the codebase, ie: every
+// pkg is cloned with the right remotes and there are no unknown clones
+func (s *WkspcStatus) Consistent() bool {
+	for _, status := range s.Pkgs {
+		if status.State != PkgPresent {
+			return false
+		}
+	}
+	return len(s.Unknown) == 0
+}
+
+// Status compares the given workspace root dir to the codebase, see
+// StatusContext()
+func (cb *Defn) Status(wkspcRoot string) (*WkspcStatus, error) {
+	return cb.StatusContext(context.Background(), wkspcRoot, 0)
+}
+
+// StatusContext compares the given workspace root dir to the codebase, the
+// clone at each pkg workspace path is checked (up to the given number of
+// pkgs at once, 0 for the codebase default, see Jobs()) and the workspace
+// is scanned for clones not in the codebase (see findClones(), the root
+// dir itself being a clone isn't an unknown clone).  The clone remotes are
+// as generated for a workspace (see gitVCS() and hgVCS()) and are compared
+// to the pkg repo and remotes ("vendor,spf13" style remote names are a
+// remote for each name).  Pkgs that can't be checked are returned as
+// PkgErrors (with the status of the rest), a done context is error 3020.
+// A missing workspace root dir is just an empty workspace.
+func (cb *Defn) StatusContext(ctx context.Context, wkspcRoot string, jobs int) (*WkspcStatus, error) {
+	status := &WkspcStatus{Pkgs: make([]PkgStatus, len(cb.Pkgs))}
+	index := make(map[*pkg.Defn]int, len(cb.Pkgs))
+	pkgs := make([]*pkg.Defn, len(cb.Pkgs))
+	for i := range cb.Pkgs {
+		pkgs[i] = &cb.Pkgs[i]
+		index[pkgs[i]] = i
+	}
+	pkgErr := cb.runPkgs(ctx, jobs, pkgs, func(ctx context.Context, p *pkg.Defn) error {
+		pkgStatus, err := cb.pkgStatus(ctx, wkspcRoot, p)
+		status.Pkgs[index[p]] = pkgStatus
+		return err
+	})
+	if err := cancelErr(ctx, "status of workspace "+wkspcRoot); err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool, len(status.Pkgs))
+	for _, pkgStatus := range status.Pkgs {
+		known[pkgStatus.WS] = true
+	}
+	if _, err := os.Stat(wkspcRoot); os.IsNotExist(err) {
+		return status, pkgErr
+	}
+	clones, err := findClones(ctx, wkspcRoot)
+	if err != nil {
+		return nil, err
+	}
+	for _, ws := range clones {
+		if ws != "." && !known[ws] {
+			status.Unknown = append(status.Unknown, ws)
+		}
+	}
+	sort.Strings(status.Unknown)
+	return status, pkgErr
+}
+
+// pkgStatus returns the state of the given pkg in the given workspace root
+func (cb *Defn) pkgStatus(ctx context.Context, wkspcRoot string, p *pkg.Defn) (PkgStatus, error) {
+	status := PkgStatus{Pkg: p.Name, State: PkgMissing}
+	ws, err := cb.PkgWS(p)
+	if err != nil {
+		return status, err
+	}
+	status.WS = ws
+	dir := filepath.Join(wkspcRoot, filepath.FromSlash(ws))
+	var vcsType string
+	if len(p.VCS) != 0 {
+		vcsType = fmt.Sprint(p.VCS[0].Type)
+	}
+	var found map[string]interface{}
+	for _, clone := range cloneVCS {
+		if _, err = os.Stat(filepath.Join(dir, clone.metaDir)); err != nil {
+			continue
+		}
+		vcs, err := clone.vcs(ctx, dir)
+		if err != nil {
+			return status, err
+		}
+		if found == nil || vcs["type"] == vcsType {
+			found = vcs
+		}
+	}
+	if found == nil {
+		return status, nil
+	}
+	status.State = PkgPresent
+	if vcsType == "" {
+		return status, nil
+	}
+	if found["type"] != vcsType {
+		status.State |= PkgWrongVCS
+		return status, nil
+	}
+	vcs := p.VCS[0]
+	repoName := "origin"
+	if vcsType == "hg" {
+		repoName = "default"
+	}
+	expected := map[string]map[string]string{repoName: vcs.Repo}
+	for remNames, access := range vcs.Remotes {
+		for _, name := range strings.Split(remNames, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				expected[name] = access
+			}
+		}
+	}
+	actual := make(map[string]map[string]string)
+	if repo, ok := found["repo"]; ok {
+		actual[repoName] = accessStrings(repo)
+	}
+	if remotes, ok := found["remotes"].(map[string]interface{}); ok {
+		for name, access := range remotes {
+			actual[name] = accessStrings(access)
+		}
+	}
+	for name, access := range expected {
+		if len(access) == 0 {
+			continue
+		}
+		if !sameAccess(access, actual[name]) {
+			status.WrongRemotes = append(status.WrongRemotes, name)
+		}
+	}
+	for name := range actual {
+		if _, ok := expected[name]; !ok {
+			status.ExtraRemotes = append(status.ExtraRemotes, name)
+		}
+	}
+	sort.Strings(status.WrongRemotes)
+	sort.Strings(status.ExtraRemotes)
+	if len(status.WrongRemotes) != 0 {
+		status.State |= PkgWrongRemote
+	}
+	if len(status.ExtraRemotes) != 0 {
+		status.State |= PkgExtraRemotes
+	}
+	return status, nil
+}
+
+// accessStrings returns the given access map (in codebase file map form,
+// see remoteAccess()) as a map of strings
+func accessStrings(access interface{}) map[string]string {
+	strs := make(map[string]string)
+	if m, ok := access.(map[string]interface{}); ok {
+		for key, url := range m {
+			if s, ok := url.(string); ok {
+				strs[key] = s
+			}
+		}
+	}
+	return strs
+}
+
+// sameAccess returns true if the given expected and actual access maps
+// give the same fetch and push URL's (see accessURLs()), "git+" scheme
+// prefixes of the expected URL's are ignored as they are for clones
+func sameAccess(expected, actual map[string]string) bool {
+	expFetch, expPush := accessURLs(expected)
+	actFetch, actPush := accessURLs(actual)
+	if expPush == "" {
+		expPush = expFetch
+	}
+	if actPush == "" {
+		actPush = actFetch
+	}
+	return gitURL(expFetch) == actFetch && gitURL(expPush) == actPush
+}
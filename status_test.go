@@ -0,0 +1,111 @@
+// Copyright © 2015 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codebase
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/dvln/out"
+)
+
+func TestStatus(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is needed for this test")
+	}
+	dir, err := ioutil.TempDir("", "codebase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	repos := filepath.Join(dir, "repos")
+	for _, name := range []string{"viper", "tools"} {
+		testBareRepo(t, filepath.Join(repos, name+".git"))
+	}
+	cb := testWkspcCodebase(t, repos)
+	wkspc := filepath.Join(dir, "wkspc")
+
+	status, err := cb.Status(wkspc)
+	if err != nil {
+		t.Fatalf("Status of the empty workspace failed: %s", err)
+	}
+	if status.Consistent() || status.Pkgs[0].State != PkgMissing || status.Pkgs[1].State != PkgMissing {
+		t.Fatalf("Expected all pkgs missing in the empty workspace, found: %+v", status)
+	}
+
+	if err = cb.Materialize(wkspc); err != nil {
+		t.Fatalf("Materialize of the workspace failed: %s", err)
+	}
+	status, err = cb.Status(wkspc)
+	if err != nil || !status.Consistent() {
+		t.Fatalf("Expected the materialized workspace to be consistent, found: %+v (%v)", status, err)
+	}
+	if status.Pkgs[0].WS != "src/dvln/lib/3rd/viper" || status.Pkgs[1].WS != "tools" {
+		t.Fatalf("Unexpected pkg workspace paths: %+v", status.Pkgs)
+	}
+
+	// remotes changed, an hg clone where a git pkg goes and unknown clones
+	viper := filepath.Join(wkspc, "src", "dvln", "lib", "3rd", "viper")
+	testGit(t, viper, "remote", "set-url", "spf13", "elsewhere")
+	testGit(t, viper, "remote", "remove", "joe")
+	testGit(t, viper, "remote", "add", "mine", "mine")
+	tools := filepath.Join(wkspc, "tools")
+	os.RemoveAll(filepath.Join(tools, ".git"))
+	if err = os.MkdirAll(filepath.Join(tools, ".hg"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	testClone(t, filepath.Join(wkspc, "src", "other"), nil)
+	testClone(t, filepath.Join(viper, "nested"), nil)
+	status, err = cb.Status(wkspc)
+	if err != nil || status.Consistent() {
+		t.Fatalf("Expected the changed workspace to be inconsistent, found: %+v (%v)", status, err)
+	}
+	expected := []PkgStatus{
+		{
+			Pkg:          "dvln/viper",
+			WS:           "src/dvln/lib/3rd/viper",
+			State:        PkgPresent | PkgWrongRemote | PkgExtraRemotes,
+			WrongRemotes: []string{"joe", "spf13"},
+			ExtraRemotes: []string{"mine"},
+		},
+		{Pkg: "tools", WS: "tools", State: PkgPresent | PkgWrongVCS},
+	}
+	if !reflect.DeepEqual(status.Pkgs, expected) {
+		t.Fatalf("Expected pkg status:\n%+v\nfound:\n%+v", expected, status.Pkgs)
+	}
+	unknown := []string{"src/dvln/lib/3rd/viper/nested", "src/other"}
+	if !reflect.DeepEqual(status.Unknown, unknown) {
+		t.Fatalf("Expected unknown clones %v, found: %v", unknown, status.Unknown)
+	}
+
+	// a workspace root that is a clone isn't an unknown clone
+	testClone(t, wkspc, nil)
+	if status, err = cb.Status(wkspc); err != nil || !reflect.DeepEqual(status.Unknown, unknown) {
+		t.Fatalf("Expected unknown clones %v with the root a clone, found: %+v (%v)", unknown, status, err)
+	}
+
+	// pkgs outside the workspace root fail, the rest are still checked
+	cb.Pkgs[1].WS = "../outside"
+	status, err = cb.Status(wkspc)
+	if errs, ok := err.(PkgErrors); !ok || len(errs) != 1 || !out.IsError(errs["tools"], nil, 3025) {
+		t.Fatalf("Status of a pkg outside the workspace should fail for just that pkg (3025), found: %v", err)
+	}
+	if status == nil || !reflect.DeepEqual(status.Pkgs[0], expected[0]) {
+		t.Fatalf("Expected the status of the other pkgs with the error, found: %+v", status)
+	}
+}
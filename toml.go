@@ -0,0 +1,73 @@
+// Copyright © 2015 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codebase
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/BurntSushi/toml"
+	"github.com/dvln/out"
+)
+
+// ReadTOML will, given an io.Reader, attempt to scan in a TOML codebase
+// definition and "fill out" the given Defn structure, it works just like
+// Read() does for JSON (same decoding, var expansion and error codes)
+func (cb *Defn) ReadTOML(r io.Reader) error {
+	codebaseMap := make(map[string]interface{})
+	if _, err := toml.DecodeReader(r, &codebaseMap); err != nil {
+		return out.WrapErr(err, "Failed to decode codebase TOML file", 3001)
+	}
+	return cb.decode(codebaseMap)
+}
+
+// WriteTOML will, given an io.Writer, attempt to write the codebase out
+// as TOML, var use is re-compacted just as Write() does for JSON
+func (cb *Defn) WriteTOML(w io.Writer) error {
+	codebaseMap, err := cb.encodeMap()
+	if err != nil {
+		return err
+	}
+	buf := new(bytes.Buffer)
+	if err = toml.NewEncoder(buf).Encode(tomlValue(codebaseMap)); err != nil {
+		return out.WrapErr(err, "Failed to encode codebase TOML", 3006)
+	}
+	if _, err = w.Write(buf.Bytes()); err != nil {
+		return out.WrapErr(err, "Failed to write codebase TOML", 3007)
+	}
+	return nil
+}
+
+// tomlValue adjusts the generic codebase map values so the TOML encoder
+// writes lists of maps as arrays of tables (eg: "[[pkgs]]")
+func tomlValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		for key, elem := range v {
+			v[key] = tomlValue(elem)
+		}
+	case []interface{}:
+		tables := make([]map[string]interface{}, 0, len(v))
+		for i, elem := range v {
+			v[i] = tomlValue(elem)
+			if table, ok := v[i].(map[string]interface{}); ok {
+				tables = append(tables, table)
+			}
+		}
+		if len(v) > 0 && len(tables) == len(v) {
+			return tables
+		}
+	}
+	return val
+}
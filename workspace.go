@@ -0,0 +1,219 @@
+// Copyright © 2015 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codebase
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dvln/out"
+	"github.com/dvln/pkg"
+)
+
+// accessURLs returns the fetch and push URL's from a repo (or remote)
+// access map, the "rw" URL is used for both if given, otherwise the fetch
+// URL is the "r" (or "read") URL and the push URL the "w" (or "write")
+// URL, for other access keys the first (sorted) is the fetch URL.  The
+// push URL is "" if it is the same as the fetch URL.
+func accessURLs(access map[string]string) (string, string) {
+	fetch, push := access["rw"], ""
+	if fetch == "" {
+		fetch = firstSet(access["r"], access["read"])
+		push = firstSet(access["w"], access["write"])
+	}
+	if fetch == "" {
+		keys := make([]string, 0, len(access))
+		for key := range access {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if key != "w" && key != "write" && access[key] != "" {
+				fetch = access[key]
+				break
+			}
+		}
+	}
+	if fetch == "" {
+		fetch, push = push, ""
+	}
+	if push == fetch {
+		push = ""
+	}
+	return fetch, push
+}
+
+func firstSet(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// Materialize builds the workspace for the codebase in the given workspace
+// root dir, see MaterializeContext()
+func (cb *Defn) Materialize(wkspcRoot string) error {
+	return cb.MaterializeContext(context.Background(), wkspcRoot, 0)
+}
+
+// MaterializeContext builds the workspace for the codebase in the given
+// workspace root dir, each pkg repo is cloned to the pkg workspace path
+// (see PkgWS()) and each of the pkg remotes is added to the clone as a
+// named git remote ("vendor,spf13" style remote names add a remote for
+// each name).  Pkgs already cloned have their remotes brought in line
+// with the codebase, the clones themselves are left alone.  Only git pkgs
+// can be materialized currently.  Up to the given number of pkgs are
+// cloned at once (0 for the codebase default, see Jobs()), pkgs nested in
+// the workspace path of another pkg are cloned once it is, a failing pkg
+// doesn't stop the others and all failures are returned as PkgErrors.
+func (cb *Defn) MaterializeContext(ctx context.Context, wkspcRoot string, jobs int) error {
+	errs := make(PkgErrors)
+	waves, err := cb.nestingWaves()
+	if err != nil {
+		errs = err.(PkgErrors)
+	}
+	for _, wave := range waves {
+		err = cb.runPkgs(ctx, jobs, wave, func(ctx context.Context, p *pkg.Defn) error {
+			return cb.materializePkg(ctx, wkspcRoot, p)
+		})
+		if err != nil {
+			for name, pkgErr := range err.(PkgErrors) {
+				errs[name] = pkgErr
+			}
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// nestingWaves groups the codebase pkgs by how deeply their workspace path
+// (see PkgWS()) is nested in the paths of other pkgs, the first wave has
+// the pkgs not nested in any other, the next those nested in one of those
+// and so on, pkgs whose path can't be worked out are returned as PkgErrors
+func (cb *Defn) nestingWaves() ([][]*pkg.Defn, error) {
+	errs := make(PkgErrors)
+	paths := make([]string, len(cb.Pkgs))
+	for i := range cb.Pkgs {
+		ws, err := cb.PkgWS(&cb.Pkgs[i])
+		if err != nil {
+			errs[cb.Pkgs[i].Name] = err
+			continue
+		}
+		paths[i] = ws
+	}
+	var waves [][]*pkg.Defn
+	for i := range cb.Pkgs {
+		if paths[i] == "" {
+			continue
+		}
+		depth := 0
+		for j, other := range paths {
+			if j != i && other != "" && (other == "." || strings.HasPrefix(paths[i], other+"/")) {
+				depth++
+			}
+		}
+		for len(waves) <= depth {
+			waves = append(waves, nil)
+		}
+		waves[depth] = append(waves[depth], &cb.Pkgs[i])
+	}
+	if len(errs) != 0 {
+		return waves, errs
+	}
+	return waves, nil
+}
+
+// materializePkg clones the given pkg into the workspace and sets up its
+// remotes, see MaterializeContext()
+func (cb *Defn) materializePkg(ctx context.Context, wkspcRoot string, p *pkg.Defn) error {
+	if len(p.VCS) == 0 {
+		out.Debugf("Pkg \"%s\" has no VCS settings, nothing to clone\n", p.Name)
+		return nil
+	}
+	vcs := p.VCS[0]
+	if vcs.Type != "git" {
+		return out.NewErrf(3022, "Unable to materialize pkg \"%s\", unsupported VCS type: %s", p.Name, vcs.Type)
+	}
+	ws, err := cb.PkgWS(p)
+	if err != nil {
+		return err
+	}
+	cloneDir := filepath.Join(wkspcRoot, filepath.FromSlash(ws))
+	if !isGitRepo(cloneDir) {
+		if entries, err := ioutil.ReadDir(cloneDir); err == nil && len(entries) != 0 {
+			return out.NewErrf(3022, "Unable to materialize pkg \"%s\", \"%s\" exists and isn't a git clone", p.Name, cloneDir)
+		}
+		fetch, _ := accessURLs(vcs.Repo)
+		if fetch == "" {
+			return out.NewErrf(3022, "Unable to materialize pkg \"%s\", no repo URL", p.Name)
+		}
+		if err = os.MkdirAll(filepath.Dir(cloneDir), 0755); err != nil {
+			return out.WrapErrf(err, 3022, "Unable to materialize pkg \"%s\" in \"%s\"", p.Name, cloneDir)
+		}
+		if _, err = git(ctx, "", "clone", "--quiet", gitURL(fetch), cloneDir); err != nil {
+			return err
+		}
+	}
+	if len(vcs.Repo) != 0 {
+		if err = setGitRemote(ctx, cloneDir, "origin", vcs.Repo); err != nil {
+			return err
+		}
+	}
+	for remNames, access := range vcs.Remotes {
+		for _, name := range strings.Split(remNames, ",") {
+			if name = strings.TrimSpace(name); name == "" {
+				continue
+			}
+			if err = setGitRemote(ctx, cloneDir, name, access); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// setGitRemote adds (or updates) the named remote in the given git clone
+// to use the URL's in the given access map (see accessURLs())
+func setGitRemote(ctx context.Context, cloneDir, name string, access map[string]string) error {
+	fetch, push := accessURLs(access)
+	if fetch == "" {
+		return out.NewErrf(3022, "Unable to set up remote \"%s\" in \"%s\", no URL", name, cloneDir)
+	}
+	current, err := git(ctx, cloneDir, "config", "--get", fmt.Sprintf("remote.%s.url", name))
+	if out.IsError(err, nil, 3020) {
+		return err
+	}
+	switch {
+	case err != nil:
+		_, err = git(ctx, cloneDir, "remote", "add", name, gitURL(fetch))
+	case strings.TrimSpace(string(current)) != gitURL(fetch):
+		_, err = git(ctx, cloneDir, "remote", "set-url", name, gitURL(fetch))
+	}
+	if err != nil {
+		return err
+	}
+	if push != "" {
+		_, err = git(ctx, cloneDir, "remote", "set-url", "--push", name, gitURL(push))
+	}
+	return err
+}
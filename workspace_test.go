@@ -0,0 +1,199 @@
+// Copyright © 2015 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codebase
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dvln/out"
+)
+
+// testBareRepo creates a bare git repo in the given dir with one commit
+func testBareRepo(t *testing.T, dir string) {
+	work := dir + ".work"
+	testClone(t, work, nil)
+	if err := ioutil.WriteFile(filepath.Join(work, "README"), []byte(dir), 0644); err != nil {
+		t.Fatal(err)
+	}
+	testGit(t, work, "add", "README")
+	testGit(t, work, "commit", "-q", "-m", "initial")
+	testGit(t, filepath.Dir(dir), "clone", "-q", "--bare", work, dir)
+}
+
+// testWkspcCodebase returns a codebase with pkgs for the bare repos in the
+// given dir, "viper" is a Go pkg with remotes and "tools" isn't
+func testWkspcCodebase(t *testing.T, dir string) *Defn {
+	contents := fmt.Sprintf(`{
+  "name": "wkspc",
+  "vars": { "repos": "file://%s" },
+  "pathing": { "wkspc_pfx_dir": "{{if .GoPkg}}src{{end}}" },
+  "pkgs": [
+    {
+      "name": "dvln/viper",
+      "ws": "dvln/lib/3rd/viper",
+      "attrs": { "GoPkg": "True" },
+      "vcs": [ {
+        "type": "git",
+        "repo": { "r": "{{.repos}}/viper.git", "w": "{{.repos}}/viper-push.git" },
+        "remotes": {
+          "vendor,spf13": { "r": "{{.repos}}/spf13.git" },
+          "joe": { "read": "{{.repos}}/joe.git" }
+        }
+      } ]
+    },
+    {
+      "name": "tools",
+      "attrs": { "GoPkg": "False" },
+      "vcs": [ { "type": "git", "repo": { "rw": "{{.repos}}/tools.git" } } ]
+    }
+  ]
+}`, filepath.ToSlash(dir))
+	cb := New()
+	if err := cb.Read(strings.NewReader(contents)); err != nil {
+		t.Fatalf("Read of the workspace codebase failed: %s", err)
+	}
+	return cb
+}
+
+func TestAccessURLs(t *testing.T) {
+	tests := []struct {
+		access      map[string]string
+		fetch, push string
+	}{
+		{map[string]string{"rw": "a", "r": "b"}, "a", ""},
+		{map[string]string{"r": "a", "w": "b"}, "a", "b"},
+		{map[string]string{"read": "a", "write": "a"}, "a", ""},
+		{map[string]string{"w": "b"}, "b", ""},
+		{map[string]string{"x": "a", "mirror": "b"}, "b", ""},
+		{nil, "", ""},
+	}
+	for _, test := range tests {
+		fetch, push := accessURLs(test.access)
+		if fetch != test.fetch || push != test.push {
+			t.Errorf("Access %v should give %q, %q, found: %q, %q", test.access, test.fetch, test.push, fetch, push)
+		}
+	}
+}
+
+func TestMaterialize(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is needed for this test")
+	}
+	dir, err := ioutil.TempDir("", "codebase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	repos := filepath.Join(dir, "repos")
+	for _, name := range []string{"viper", "tools"} {
+		testBareRepo(t, filepath.Join(repos, name+".git"))
+	}
+	cb := testWkspcCodebase(t, repos)
+	wkspc := filepath.Join(dir, "wkspc")
+	if err = cb.Materialize(wkspc); err != nil {
+		t.Fatalf("Materialize of the workspace failed: %s", err)
+	}
+	viper := filepath.Join(wkspc, "src", "dvln", "lib", "3rd", "viper")
+	if _, err = os.Stat(filepath.Join(viper, "README")); err != nil {
+		t.Fatalf("The viper pkg should be cloned under the src prefix: %s", err)
+	}
+	if _, err = os.Stat(filepath.Join(wkspc, "tools", "README")); err != nil {
+		t.Fatalf("The tools pkg should be cloned with no prefix: %s", err)
+	}
+	remotes := map[string]string{
+		"remote.origin.url":     repos + "/viper.git",
+		"remote.origin.pushurl": repos + "/viper-push.git",
+		"remote.vendor.url":     repos + "/spf13.git",
+		"remote.spf13.url":      repos + "/spf13.git",
+		"remote.joe.url":        repos + "/joe.git",
+	}
+	for key, url := range remotes {
+		if found := testGit(t, viper, "config", "--get", key); found != "file://"+filepath.ToSlash(url) {
+			t.Errorf("Expected viper clone %s to be %q, found: %q", key, "file://"+url, found)
+		}
+	}
+
+	// materializing again brings the remotes in line, clones are left alone
+	testGit(t, viper, "remote", "set-url", "joe", "elsewhere")
+	if err = cb.Materialize(wkspc); err != nil {
+		t.Fatalf("Materialize of the existing workspace failed: %s", err)
+	}
+	if found := testGit(t, viper, "config", "--get", "remote.joe.url"); !strings.HasSuffix(found, "/joe.git") {
+		t.Errorf("Expected the joe remote to be reset, found: %q", found)
+	}
+
+	// pkg dirs in the way (that aren't clones) are reported
+	os.RemoveAll(filepath.Join(wkspc, "tools"))
+	if err = os.MkdirAll(filepath.Join(wkspc, "tools", "stuff"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	err = cb.Materialize(wkspc)
+	if errs, ok := err.(PkgErrors); !ok || len(errs) != 1 || !out.IsError(errs["tools"], nil, 3022) {
+		t.Fatalf("Materialize over a non-clone dir should fail for just that pkg (3022), found: %v", err)
+	}
+	os.RemoveAll(filepath.Join(wkspc, "tools"))
+
+	// pkgs outside the workspace root are never cloned
+	cb.Pkgs[1].WS = "../outside"
+	err = cb.Materialize(wkspc)
+	if errs, ok := err.(PkgErrors); !ok || len(errs) != 1 || !out.IsError(errs["tools"], nil, 3025) {
+		t.Fatalf("Materialize of a pkg outside the workspace should fail for just that pkg (3025), found: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "outside")); !os.IsNotExist(err) {
+		t.Fatalf("No clone should be made outside the workspace: %v", err)
+	}
+}
+
+func TestMaterializeNested(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is needed for this test")
+	}
+	dir, err := ioutil.TempDir("", "codebase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	repos := filepath.Join(dir, "repos")
+	var pkgs []interface{}
+	for _, name := range []string{"top/mid/leaf", "top/mid", "top"} {
+		repo := filepath.Join(repos, strings.Replace(name, "/", "_", -1)+".git")
+		testBareRepo(t, repo)
+		pkgs = append(pkgs, map[string]interface{}{
+			"name": name,
+			"ws":   name,
+			"vcs":  []interface{}{map[string]interface{}{"type": "git", "repo": map[string]interface{}{"rw": repo}}},
+		})
+	}
+	cb := New()
+	if err = cb.decode(map[string]interface{}{"name": "nested", "pkgs": pkgs}); err != nil {
+		t.Fatal(err)
+	}
+	// leaf first in the codebase, but nested clones must wait for their parent
+	wkspc := filepath.Join(dir, "wkspc")
+	if err = cb.MaterializeContext(context.Background(), wkspc, 3); err != nil {
+		t.Fatalf("Materialize of nested pkgs failed: %s", err)
+	}
+	for _, name := range []string{"top", "top/mid", "top/mid/leaf"} {
+		if _, err = os.Stat(filepath.Join(wkspc, name, "README")); err != nil {
+			t.Errorf("Expected pkg %s to be cloned: %s", name, err)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright © 2015 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codebase
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/dvln/out"
+	"gopkg.in/yaml.v2"
+)
+
+// ReadYAML will, given an io.Reader, attempt to scan in a YAML codebase
+// definition and "fill out" the given Defn structure, it works just like
+// Read() does for JSON (same decoding, var expansion and error codes)
+func (cb *Defn) ReadYAML(r io.Reader) error {
+	contents, err := ioutil.ReadAll(r)
+	if err != nil {
+		return out.WrapErr(err, "Failed to read codebase YAML", 3001)
+	}
+	codebaseMap := make(map[string]interface{})
+	if err = yaml.Unmarshal(contents, &codebaseMap); err != nil {
+		return out.WrapErr(err, "Failed to decode codebase YAML file", 3001)
+	}
+	return cb.decode(yamlValue(codebaseMap).(map[string]interface{}))
+}
+
+// WriteYAML will, given an io.Writer, attempt to write the codebase out
+// as YAML, var use is re-compacted just as Write() does for JSON
+func (cb *Defn) WriteYAML(w io.Writer) error {
+	codebaseMap, err := cb.encodeMap()
+	if err != nil {
+		return err
+	}
+	b, err := yaml.Marshal(codebaseMap)
+	if err != nil {
+		return out.WrapErr(err, "Failed to encode codebase YAML", 3006)
+	}
+	if _, err = w.Write(b); err != nil {
+		return out.WrapErr(err, "Failed to write codebase YAML", 3007)
+	}
+	return nil
+}
+
+// yamlValue turns the map[interface{}]interface{} maps the YAML decoder
+// returns for nested maps into the map[string]interface{} maps the rest
+// of the codebase decoding expects, recursively
+func yamlValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, elem := range v {
+			m[fmt.Sprintf("%v", key)] = yamlValue(elem)
+		}
+		return m
+	case map[string]interface{}:
+		for key, elem := range v {
+			v[key] = yamlValue(elem)
+		}
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = yamlValue(elem)
+		}
+	}
+	return val
+}
@@ -0,0 +1,99 @@
+// Copyright © 2015 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codebase
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dvln/out"
+)
+
+var codebaseYAMLExample = []byte(`name: dvln
+desc: Multi-package and workspace management tool
+attrs:
+  jobs: "4"
+  linkalias: "True"
+vars:
+  dvln: http://github.com/dvln
+  spf13: http://github.com/spf13
+access:
+  "m,^{{.dvln}}/*, && Vendor!=True":
+    read: open
+pkgs:
+  - id: "22"
+    name: dvln/lib/3rd/viper
+    ws: src/dvln/lib/3rd/viper
+    status: active
+    vcs:
+      - type: git
+        repo: { rw: "{{.dvln}}/viper" }
+        remotes:
+          vendor,spf13: { r: "{{.spf13}}/viper" }
+`)
+
+func TestCodebaseYAMLRead(t *testing.T) {
+	codebaseDefn := New()
+	err := codebaseDefn.ReadYAML(bytes.NewReader(codebaseYAMLExample))
+	if err != nil {
+		t.Fatalf("Error reading pre-defined codebase YAML: %s", err)
+	}
+	if codebaseDefn.Name != "dvln" || codebaseDefn.Attrs["jobs"] != "4" {
+		t.Fatalf("Codebase YAML name or attrs not read correctly: %+v", codebaseDefn)
+	}
+	if len(codebaseDefn.Pkgs) != 1 || len(codebaseDefn.Pkgs[0].VCS) != 1 {
+		t.Fatalf("Codebase YAML should have 1 pkg with 1 vcs: %+v", codebaseDefn.Pkgs)
+	}
+	vcs := codebaseDefn.Pkgs[0].VCS[0]
+	if vcs.Repo["rw"] != "http://github.com/dvln/viper" || vcs.Remotes["vendor,spf13"]["r"] != "http://github.com/spf13/viper" {
+		t.Fatalf("Codebase YAML vars were not expanded: %+v", vcs)
+	}
+	if _, ok := codebaseDefn.Access["m,^http://github.com/dvln/*, && Vendor!=True"]; !ok {
+		t.Fatalf("Codebase YAML access conditional was not expanded: %v", codebaseDefn.Access)
+	}
+
+	err = New().ReadYAML(strings.NewReader("name: [dvln"))
+	if !out.IsError(err, nil, 3001) {
+		t.Fatalf("Bad codebase YAML should fail with error 3001, found: %v", err)
+	}
+	err = New().ReadYAML(strings.NewReader("name: dvln\npkgs:\n  - vcs:\n      - repo: { rw: \"{{.dvln}/viper\" }\n"))
+	if !out.IsError(err, nil, 3004) {
+		t.Fatalf("Bad codebase YAML template should fail with error 3004, found: %v", err)
+	}
+}
+
+func TestCodebaseYAMLWrite(t *testing.T) {
+	codebaseDefn := New()
+	err := codebaseDefn.Read(bytes.NewReader(codebaseExample))
+	if err != nil {
+		t.Fatalf("Error reading pre-defined codebase JSON: %s", err)
+	}
+	w := new(bytes.Buffer)
+	if err = codebaseDefn.WriteYAML(w); err != nil {
+		t.Fatalf("Error writing codebase YAML: %s", err)
+	}
+	written := w.String()
+	if !strings.Contains(written, "{{.dvln}}/viper") {
+		t.Fatalf("Written codebase YAML should have compacted vars:\n%s", written)
+	}
+	roundTrip := New()
+	if err = roundTrip.ReadYAML(w); err != nil {
+		t.Fatalf("Error reading back written codebase YAML: %s\n%s", err, written)
+	}
+	if !reflect.DeepEqual(codebaseDefn, roundTrip) {
+		t.Fatalf("Codebase JSON read, YAML write/read round trip failed to match, written:\n%s", written)
+	}
+}